@@ -11,6 +11,7 @@
 package api
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"github.com/go-chi/chi/v5"
@@ -23,18 +24,24 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis_rate/v10"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/google/uuid"
 
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/internal/blob"
 	"github.com/kimenyu/executive/internal/logging"
+	"github.com/kimenyu/executive/internal/mail"
 	"github.com/kimenyu/executive/services/address"
 	"github.com/kimenyu/executive/services/cart"
 	"github.com/kimenyu/executive/services/category"
 	"github.com/kimenyu/executive/services/order"
 	"github.com/kimenyu/executive/services/payment"
+	"github.com/kimenyu/executive/services/payment/card"
+	"github.com/kimenyu/executive/services/payment/mpesa"
 	"github.com/kimenyu/executive/services/product"
 	"github.com/kimenyu/executive/services/review"
 	"github.com/kimenyu/executive/services/user"
@@ -136,6 +143,33 @@ func (s *APIServer) Run() error {
 	// ===== Swagger =====
 	router.Get("/swagger/*", httpSwagger.WrapHandler)
 
+	// ===== Uploads =====
+	blobConfig := blob.Config{
+		Driver:    configs.Envs.BlobDriver,
+		PublicURL: configs.Envs.BlobPublicURL,
+		Dir:       configs.Envs.BlobDir,
+		Endpoint:  configs.Envs.S3Endpoint,
+		Region:    configs.Envs.S3Region,
+		Bucket:    configs.Envs.S3Bucket,
+		AccessKey: configs.Envs.S3AccessKey,
+		SecretKey: configs.Envs.S3SecretKey,
+	}
+	if !strings.EqualFold(blobConfig.Driver, "s3") {
+		if blobConfig.PublicURL == "" {
+			blobConfig.PublicURL = configs.Envs.PublicHost + ":" + configs.Envs.Port + "/uploads"
+		}
+		// files only, no directory listings
+		files := http.StripPrefix("/uploads/", http.FileServer(http.Dir(blobConfig.Dir)))
+		router.Get("/uploads/*", func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/") {
+				http.NotFound(w, r)
+				return
+			}
+			files.ServeHTTP(w, r)
+		})
+	}
+	blobs := blob.New(blobConfig)
+
 	// ===== API v1 routes =====
 	router.Route("/api/v1", func(r chi.Router) {
 		// stores
@@ -148,15 +182,66 @@ func (s *APIServer) Run() error {
 		addressStore := address.NewStore(s.db)
 		paymentStore := payment.NewStore(s.db)
 
+		// first admin
+		if configs.Envs.AdminEmail != "" {
+			if err := user.BootstrapAdmin(userStore, configs.Envs.AdminName, configs.Envs.AdminEmail, configs.Envs.AdminPassword); err != nil {
+				log.Printf("admin bootstrap failed: %v", err)
+			}
+		}
+
 		// handlers
-		userHandler := user.NewHandler(userStore)
-		productHandler := product.NewHandler(productStore)
-		categoryHandler := category.NewHandler(categoryStore)
+		mailer := mail.New(mail.Config{
+			Driver:   configs.Envs.MailDriver,
+			Host:     configs.Envs.SMTPHost,
+			Port:     configs.Envs.SMTPPort,
+			Username: configs.Envs.SMTPUsername,
+			Password: configs.Envs.SMTPPassword,
+			From:     configs.Envs.MailFrom,
+			LogFile:  configs.Envs.MailLogFile,
+		})
+
+		userHandler := user.NewHandler(userStore, mailer)
+		productHandler := product.NewHandler(productStore, userStore, blobs)
+		categoryHandler := category.NewHandler(categoryStore, userStore)
 		reviewHandler := review.NewHandler(reviewStore, userStore)
-		cartHandler := cart.NewHandler(cartStore, userStore)
-		orderHandler := order.NewHandler(orderStore, userStore, addressStore)
+		cartHandler := cart.NewHandler(cartStore, userStore, productStore)
+		orderHandler := order.NewHandler(orderStore, userStore, addressStore, productStore, cartStore)
 		addressHandler := address.NewHandler(addressStore, userStore)
-		paymentHandler := payment.NewHandler(paymentStore, orderStore)
+		mpesaClient := mpesa.NewClient(mpesa.Config{
+			BaseURL:        configs.Envs.MpesaBaseURL,
+			ConsumerKey:    configs.Envs.MpesaConsumerKey,
+			ConsumerSecret: configs.Envs.MpesaConsumerSecret,
+			ShortCode:      configs.Envs.MpesaShortCode,
+			Passkey:        configs.Envs.MpesaPasskey,
+			CallbackURL:    payment.WithToken(configs.Envs.MpesaCallbackURL, configs.Envs.MpesaCallbackToken),
+
+			InitiatorName:      configs.Envs.MpesaInitiatorName,
+			SecurityCredential: configs.Envs.MpesaSecurityCredential,
+			B2CShortCode:       configs.Envs.MpesaB2CShortCode,
+			ResultURL:          payment.WithToken(configs.Envs.MpesaResultURL, configs.Envs.MpesaCallbackToken),
+			TimeoutURL:         payment.WithToken(configs.Envs.MpesaTimeoutURL, configs.Envs.MpesaCallbackToken),
+		})
+		providers := []payment.PaymentProvider{
+			payment.NewMpesaProvider(mpesaClient),
+			payment.NewCashOnDeliveryProvider(),
+		}
+		if configs.Envs.CardGatewayURL != "" {
+			providers = append(providers, payment.NewCardProvider(card.NewClient(card.Config{
+				BaseURL:     configs.Envs.CardGatewayURL,
+				APIKey:      configs.Envs.CardGatewayAPIKey,
+				Currency:    configs.Envs.CardCurrency,
+				CallbackURL: configs.Envs.CardCallbackURL,
+				ReturnURL:   configs.Envs.CardReturnURL,
+			})))
+		}
+		paymentProviders := payment.NewRegistry(providers...)
+
+		reconciler := payment.NewReconciler(paymentStore, orderStore, paymentProviders,
+			time.Duration(configs.Envs.PaymentReconcileAfterMinutes)*time.Minute)
+		if interval := configs.Envs.PaymentReconcileIntervalSeconds; interval > 0 {
+			go reconciler.Run(context.Background(), time.Duration(interval)*time.Second)
+		}
+		paymentHandler := payment.NewHandler(paymentStore, orderStore, userStore, paymentProviders, reconciler)
 
 		// per-request attrs for authenticated user
 		r.Use(func(next http.Handler) http.Handler {
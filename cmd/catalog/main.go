@@ -0,0 +1,132 @@
+// Command catalog imports and exports products in bulk.
+//
+//	catalog import [-dry-run] [-format csv|jsonl] FILE   upsert products by SKU, "-" reads stdin
+//	catalog export [-format csv|jsonl] [FILE]            write every variant, to stdout without FILE
+//
+// The format defaults to the file extension, csv otherwise. The database
+// comes from DATABASE_URL, as for the API.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kimenyu/executive/db"
+	"github.com/kimenyu/executive/services/product"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: catalog import [-dry-run] [-format csv|jsonl] FILE | export [-format csv|jsonl] [FILE]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.Usage = usage
+	format := flags.String("format", "", "csv or jsonl, taken from the file extension by default")
+	dryRun := flags.Bool("dry-run", false, "validate and report without saving (import only)")
+	flags.Parse(os.Args[2:])
+	args := flags.Args()
+
+	switch os.Args[1] {
+	case "import":
+		if len(args) != 1 {
+			usage()
+		}
+		os.Exit(runImport(args[0], formatFor(*format, args[0]), *dryRun))
+
+	case "export":
+		if len(args) > 1 {
+			usage()
+		}
+		var path string
+		if len(args) == 1 {
+			path = args[0]
+		}
+		if err := runExport(path, formatFor(*format, path)); err != nil {
+			log.Fatal(err)
+		}
+
+	default:
+		usage()
+	}
+}
+
+// formatFor picks the explicit format, else the one named by the file
+// extension, else CSV.
+func formatFor(format, path string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return product.FormatJSONL
+	}
+	return product.FormatCSV
+}
+
+// runImport prints the report as JSON and exits non-zero when a row failed.
+func runImport(path, format string, dryRun bool) int {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	conn, err := db.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	report, err := product.ImportCatalog(product.NewStore(conn), in, format, dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runExport(path, format string) error {
+	conn, err := db.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if path == "" {
+		return product.ExportCatalog(product.NewStore(conn), os.Stdout, format)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := product.ExportCatalog(product.NewStore(conn), f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
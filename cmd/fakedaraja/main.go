@@ -0,0 +1,198 @@
+// Command fakedaraja is an in-memory stand-in for the parts of the
+// Safaricom Daraja API the payment package uses: OAuth, STK push and
+// query, reversals and B2C. Point MPESA_BASE_URL at it. Results are posted
+// to the callback and result URLs from the requests after a short delay.
+//
+// FAKE_DARAJA_STK_RESULT picks the STK outcome: success (default), failed,
+// or silent, which never sends the callback but answers STK queries with
+// success, for exercising the reconciler.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const delay = time.Second
+
+type stkRequest struct {
+	Amount      int    `json:"Amount"`
+	PhoneNumber string `json:"PhoneNumber"`
+	CallBackURL string `json:"CallBackURL"`
+}
+
+type server struct {
+	stkResult string
+
+	mu       sync.Mutex
+	checkout map[string]stkRequest
+}
+
+func main() {
+	addr := os.Getenv("FAKE_DARAJA_ADDR")
+	if addr == "" {
+		addr = "localhost:8092"
+	}
+
+	s := &server{
+		stkResult: os.Getenv("FAKE_DARAJA_STK_RESULT"),
+		checkout:  map[string]stkRequest{},
+	}
+
+	r := chi.NewRouter()
+	r.Get("/oauth/v1/generate", s.oauth)
+	r.Post("/mpesa/stkpush/v1/processrequest", s.stkPush)
+	r.Post("/mpesa/stkpushquery/v1/query", s.stkQuery)
+	r.Post("/mpesa/reversal/v1/request", s.async("reversal"))
+	r.Post("/mpesa/b2c/v1/paymentrequest", s.async("b2c"))
+
+	log.Printf("fake daraja listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, r))
+}
+
+func (s *server) oauth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": "fake-token", "expires_in": "3599"})
+}
+
+func (s *server) stkPush(w http.ResponseWriter, r *http.Request) {
+	var in stkRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Amount < 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errorCode": "400.002.02", "errorMessage": "Bad Request"})
+		return
+	}
+
+	checkoutID := "ws_CO_" + uuid.NewString()[:8]
+	merchantID := uuid.NewString()[:8]
+
+	s.mu.Lock()
+	s.checkout[checkoutID] = in
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"MerchantRequestID":   merchantID,
+		"CheckoutRequestID":   checkoutID,
+		"ResponseCode":        "0",
+		"ResponseDescription": "Success. Request accepted for processing",
+		"CustomerMessage":     "Success. Request accepted for processing",
+	})
+
+	if s.stkResult == "silent" {
+		return
+	}
+
+	callback := map[string]any{
+		"MerchantRequestID": merchantID,
+		"CheckoutRequestID": checkoutID,
+		"ResultCode":        1032,
+		"ResultDesc":        "Request cancelled by user",
+	}
+	if s.stkResult != "failed" {
+		callback["ResultCode"] = 0
+		callback["ResultDesc"] = "The service request is processed successfully."
+		callback["CallbackMetadata"] = map[string]any{"Item": []map[string]any{
+			{"Name": "Amount", "Value": in.Amount},
+			{"Name": "MpesaReceiptNumber", "Value": receipt()},
+			{"Name": "TransactionDate", "Value": time.Now().Format("20060102150405")},
+			{"Name": "PhoneNumber", "Value": in.PhoneNumber},
+		}}
+	}
+	go post(in.CallBackURL, map[string]any{"Body": map[string]any{"stkCallback": callback}})
+}
+
+func (s *server) stkQuery(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		CheckoutRequestID string `json:"CheckoutRequestID"`
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+
+	s.mu.Lock()
+	_, ok := s.checkout[in.CheckoutRequestID]
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{
+			"errorCode": "500.001.1001", "errorMessage": "The transaction is being processed",
+		})
+		return
+	}
+
+	code, desc := "0", "The service request is processed successfully."
+	if s.stkResult == "failed" {
+		code, desc = "1032", "Request cancelled by user"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"ResponseCode":        "0",
+		"ResponseDescription": "The service request has been accepted successsfully",
+		"MerchantRequestID":   uuid.NewString()[:8],
+		"CheckoutRequestID":   in.CheckoutRequestID,
+		"ResultCode":          code,
+		"ResultDesc":          desc,
+	})
+}
+
+// async answers reversal and B2C requests, then posts a successful result.
+func (s *server) async(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Amount    int    `json:"Amount"`
+			ResultURL string `json:"ResultURL"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Amount < 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"errorCode": "400.002.02", "errorMessage": "Bad Request"})
+			return
+		}
+
+		conversationID := "AG_" + uuid.NewString()[:8]
+		originatorID := uuid.NewString()[:8]
+		writeJSON(w, http.StatusOK, map[string]string{
+			"OriginatorConversationID": originatorID,
+			"ConversationID":           conversationID,
+			"ResponseCode":             "0",
+			"ResponseDescription":      "Accept the service request successfully.",
+		})
+
+		go post(in.ResultURL, map[string]any{"Result": map[string]any{
+			"ResultType":               0,
+			"ResultCode":               0,
+			"ResultDesc":               fmt.Sprintf("The %s request is processed successfully.", name),
+			"OriginatorConversationID": originatorID,
+			"ConversationID":           conversationID,
+			"TransactionID":            receipt(),
+		}})
+	}
+}
+
+func post(url string, body any) {
+	time.Sleep(delay)
+	if url == "" {
+		return
+	}
+
+	b, _ := json.Marshal(body)
+	res, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("posting to %s: %v", url, err)
+		return
+	}
+	res.Body.Close()
+	log.Printf("posted to %s: %s", url, res.Status)
+}
+
+func receipt() string {
+	return "FAKE" + uuid.NewString()[:6]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,212 @@
+// Command fakegateway is an in-memory card gateway for local development.
+// It speaks the protocol described in services/payment/card: point
+// CARD_GATEWAY_URL at it, open a charge's checkout_url and add
+// ?outcome=failed to decline instead of pay. Webhooks are signed with
+// CARD_WEBHOOK_SECRET.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/services/payment"
+	"github.com/kimenyu/executive/services/payment/card"
+)
+
+type chargeRecord struct {
+	card.Charge
+	Refunded    int64  `json:"refunded"`
+	CallbackURL string `json:"-"`
+	ReturnURL   string `json:"-"`
+}
+
+type gateway struct {
+	addr    string
+	secret  []byte
+	mu      sync.Mutex
+	charges map[string]*chargeRecord
+}
+
+func main() {
+	addr := os.Getenv("FAKE_GATEWAY_ADDR")
+	if addr == "" {
+		addr = "localhost:8090"
+	}
+
+	g := &gateway{
+		addr:    addr,
+		secret:  []byte(os.Getenv("CARD_WEBHOOK_SECRET")),
+		charges: map[string]*chargeRecord{},
+	}
+
+	r := chi.NewRouter()
+	r.Post("/charges", g.createCharge)
+	r.Get("/charges/{id}", g.getCharge)
+	r.Post("/charges/{id}/refunds", g.createRefund)
+	r.Get("/checkout/{id}", g.checkout)
+
+	log.Printf("fake card gateway listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, r))
+}
+
+func (g *gateway) createCharge(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Amount      int64  `json:"amount"`
+		Currency    string `json:"currency"`
+		Reference   string `json:"reference"`
+		CallbackURL string `json:"callback_url"`
+		ReturnURL   string `json:"return_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid charge"})
+		return
+	}
+
+	id := "ch_" + uuid.NewString()[:8]
+	c := &chargeRecord{
+		Charge: card.Charge{
+			ID:          id,
+			Status:      card.StatusPending,
+			Amount:      in.Amount,
+			Currency:    in.Currency,
+			Reference:   in.Reference,
+			CheckoutURL: fmt.Sprintf("http://%s/checkout/%s", g.addr, id),
+		},
+		CallbackURL: in.CallbackURL,
+		ReturnURL:   in.ReturnURL,
+	}
+
+	g.mu.Lock()
+	g.charges[id] = c
+	g.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, c.Charge)
+}
+
+func (g *gateway) getCharge(w http.ResponseWriter, r *http.Request) {
+	c, ok := g.charge(chi.URLParam(r, "id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such charge"})
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (g *gateway) createRefund(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Amount int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid refund"})
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c, ok := g.charges[chi.URLParam(r, "id")]
+	if !ok || c.Status != card.StatusSucceeded {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no refundable charge"})
+		return
+	}
+	if c.Refunded+in.Amount > c.Amount {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "refund exceeds charge"})
+		return
+	}
+	c.Refunded += in.Amount
+
+	writeJSON(w, http.StatusCreated, card.Refund{
+		ID:       "re_" + uuid.NewString()[:8],
+		ChargeID: c.ID,
+		Status:   card.StatusSucceeded,
+		Amount:   in.Amount,
+	})
+}
+
+// checkout stands in for the hosted payment page: visiting it completes
+// the charge and sends the webhook.
+func (g *gateway) checkout(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	c, ok := g.charges[chi.URLParam(r, "id")]
+	if ok && c.Status == card.StatusPending {
+		c.Status = card.StatusSucceeded
+		if r.URL.Query().Get("outcome") == card.StatusFailed {
+			c.Status = card.StatusFailed
+		}
+	}
+	var charge card.Charge
+	if ok {
+		charge = c.Charge
+	}
+	g.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := g.notify(c.CallbackURL, charge); err != nil {
+		log.Printf("webhook for %s failed: %v", charge.ID, err)
+	}
+
+	if c.ReturnURL != "" {
+		http.Redirect(w, r, c.ReturnURL, http.StatusFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, charge)
+}
+
+func (g *gateway) notify(callbackURL string, charge card.Charge) error {
+	if callbackURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(card.Event{Type: "charge.updated", Data: charge})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(payment.TimestampHeader, timestamp)
+	req.Header.Set(payment.SignatureHeader, payment.Sign(g.secret, timestamp, body))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	log.Printf("webhook for %s: %s", charge.ID, res.Status)
+	return nil
+}
+
+func (g *gateway) charge(id string) (chargeRecord, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c, ok := g.charges[id]
+	if !ok {
+		return chargeRecord{}, false
+	}
+	return *c, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,161 @@
+// Command fakes3 is an in-memory, path-style S3 stand-in for local
+// development, in the spirit of MinIO. It accepts signed PUT and DELETE
+// requests, checking the SigV4 signature against S3_ACCESS_KEY and
+// S3_SECRET_KEY, and serves objects to anyone with GET, like a public-read
+// bucket. Point S3_ENDPOINT at it and set BLOB_DRIVER=s3.
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kimenyu/executive/internal/blob"
+)
+
+type object struct {
+	data        []byte
+	contentType string
+}
+
+type server struct {
+	accessKey string
+	secretKey string
+	region    string
+
+	mu      sync.Mutex
+	objects map[string]object // "bucket/key"
+}
+
+func main() {
+	addr := getenv("FAKE_S3_ADDR", "localhost:9000")
+
+	s := &server{
+		accessKey: getenv("S3_ACCESS_KEY", "minioadmin"),
+		secretKey: getenv("S3_SECRET_KEY", "minioadmin"),
+		region:    getenv("S3_REGION", "us-east-1"),
+		objects:   map[string]object{},
+	}
+
+	log.Printf("fake S3 listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, s))
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket, key, _ := strings.Cut(name, "/"); bucket == "" || key == "" {
+		s.error(w, http.StatusBadRequest, "InvalidRequest", "path-style bucket/key required")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.Lock()
+		obj, ok := s.objects[name]
+		s.mu.Unlock()
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+
+	case http.MethodPut:
+		body, ok := s.authenticate(w, r)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		s.objects[name] = object{data: body, contentType: r.Header.Get("Content-Type")}
+		s.mu.Unlock()
+		log.Printf("PUT %s (%d bytes)", name, len(body))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		if _, ok := s.authenticate(w, r); !ok {
+			return
+		}
+		s.mu.Lock()
+		delete(s.objects, name)
+		s.mu.Unlock()
+		log.Printf("DELETE %s", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	}
+}
+
+// authenticate re-signs the request with the shared secret and compares
+// the result with what the client sent. It returns the body it read.
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return nil, false
+	}
+
+	got := r.Header.Get("Authorization")
+	at, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if got == "" || err != nil {
+		s.error(w, http.StatusForbidden, "AccessDenied", "missing signature")
+		return nil, false
+	}
+	if d := time.Since(at); d > 15*time.Minute || d < -15*time.Minute {
+		s.error(w, http.StatusForbidden, "RequestTimeTooSkewed", "")
+		return nil, false
+	}
+
+	// sign a copy carrying only the headers the client signed
+	check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	check.Host = r.Host
+	for _, h := range signedHeaders(got) {
+		if h != "host" && h != "x-amz-date" && h != "x-amz-content-sha256" {
+			check.Header.Set(h, r.Header.Get(h))
+		}
+	}
+	blob.Sign(check, body, s.accessKey, s.secretKey, s.region, "s3", at)
+
+	if check.Header.Get("Authorization") != got {
+		s.error(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return nil, false
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != check.Header.Get("X-Amz-Content-Sha256") {
+		s.error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "")
+		return nil, false
+	}
+	return body, true
+}
+
+func signedHeaders(auth string) []string {
+	_, rest, ok := strings.Cut(auth, "SignedHeaders=")
+	if !ok {
+		return nil
+	}
+	list, _, _ := strings.Cut(rest, ",")
+	return strings.Split(list, ";")
+}
+
+func (s *server) error(w http.ResponseWriter, status int, code, msg string) {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>` + code + `</Code><Message>` + msg + `</Message></Error>`)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 
 	"github.com/kimenyu/executive/cmd/api"
+	"github.com/kimenyu/executive/cmd/migrate/migrations"
+	"github.com/kimenyu/executive/configs"
 	"github.com/kimenyu/executive/db"
+	"github.com/kimenyu/executive/internal/migrate"
 
 	"github.com/joho/godotenv"
 )
@@ -27,6 +31,17 @@ func main() {
 		log.Fatal("Failed to connect to DB:", err)
 	}
 
+	// replicas starting together are serialised by the migration lock
+	if configs.Envs.MigrateOnStart {
+		m, err := migrate.New(dbConn, migrations.FS)
+		if err != nil {
+			log.Fatal("Failed to load migrations:", err)
+		}
+		if _, err := m.Up(context.Background(), 0); err != nil {
+			log.Fatal("Migrations failed:", err)
+		}
+	}
+
 	server := api.NewAPIServer(fmt.Sprintf(":%s", addr), dbConn)
 	if err := server.Run(); err != nil {
 		log.Fatal("Server failed:", err)
@@ -0,0 +1,154 @@
+// Command migrate manages the database schema.
+//
+//	migrate up [n]        apply all pending migrations, or the next n
+//	migrate down [n]      revert the last migration, or the last n
+//	migrate status        list migrations and when they were applied
+//	migrate create NAME   add empty NNN_name.sql and NNN_name.down.sql files
+//	migrate force VERSION mark migrations up to VERSION as applied without running them
+//
+// The database comes from DATABASE_URL, as for the API.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kimenyu/executive/cmd/migrate/migrations"
+	"github.com/kimenyu/executive/db"
+	"github.com/kimenyu/executive/internal/migrate"
+)
+
+func main() {
+	dir := flag.String("dir", "cmd/migrate/migrations", "directory new migrations are created in")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: migrate [-dir DIR] up [n] | down [n] | status | create NAME | force VERSION")
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// create only touches files, so it works without a database
+	if args[0] == "create" {
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := create(*dir, args[1]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	conn, err := db.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	m, err := migrate.New(conn, migrations.FS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx, count(args))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("applied %d migration(s)", n)
+
+	case "down":
+		n, err := m.Down(ctx, count(args))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("reverted %d migration(s)", n)
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%03d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+
+	case "force":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			log.Fatalf("invalid version %q", args[1])
+		}
+		if err := m.Force(ctx, version); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("forced schema to version %d", version)
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// count reads the optional step count of up and down.
+func count(args []string) int {
+	if len(args) < 2 {
+		return 0
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		log.Fatalf("invalid count %q", args[1])
+	}
+	return n
+}
+
+var nonWord = regexp.MustCompile(`\W+`)
+
+// create adds the next numbered pair of migration files to dir.
+func create(dir, name string) error {
+	name = strings.Trim(nonWord.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return fmt.Errorf("invalid migration name")
+	}
+
+	m, err := migrate.New(nil, os.DirFS(dir))
+	if err != nil {
+		return err
+	}
+
+	var next int64 = 1
+	if all := m.Migrations(); len(all) > 0 {
+		next = all[len(all)-1].Version + 1
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%03d_%s", next, name))
+	for _, path := range []string{base + ".sql", base + ".down.sql"} {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		fmt.Println(path)
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+-- user roles
+ALTER TABLE users
+    ADD COLUMN role TEXT NOT NULL DEFAULT 'customer'
+        CHECK (role IN ('customer', 'staff', 'admin'));
+
+CREATE INDEX idx_users_role ON users(role);
@@ -0,0 +1,18 @@
+-- email verification
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+
+-- accounts that predate verification keep checking out
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
+
+-- user_tokens (single-use password reset and email verification tokens)
+CREATE TABLE user_tokens (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL CHECK (purpose IN ('password_reset', 'email_verification')),
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_user_tokens_user_id ON user_tokens(user_id, purpose);
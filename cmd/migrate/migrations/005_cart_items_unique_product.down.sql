@@ -0,0 +1,2 @@
+-- merged duplicate lines stay merged
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_cart_id_product_id_key;
@@ -0,0 +1,19 @@
+-- merge duplicate cart lines into the oldest one before adding the constraint
+UPDATE cart_items ci
+SET quantity = dup.quantity
+FROM (
+    SELECT cart_id, product_id, SUM(quantity) AS quantity
+    FROM cart_items
+    GROUP BY cart_id, product_id
+    HAVING COUNT(*) > 1
+) dup
+WHERE ci.cart_id = dup.cart_id AND ci.product_id = dup.product_id;
+
+DELETE FROM cart_items ci
+USING cart_items other
+WHERE ci.cart_id = other.cart_id
+  AND ci.product_id = other.product_id
+  AND (ci.created_at, ci.id::text) > (other.created_at, other.id::text);
+
+ALTER TABLE cart_items
+    ADD CONSTRAINT cart_items_cart_id_product_id_key UNIQUE (cart_id, product_id);
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS order_status_history;
+ALTER TABLE orders DROP COLUMN IF EXISTS updated_at;
+
+-- statuses the original schema does not know fall back to the closest one
+UPDATE orders SET status = 'shipped' WHERE status IN ('delivered', 'completed');
+UPDATE orders SET status = 'cancelled' WHERE status = 'refunded';
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('pending', 'paid', 'shipped', 'cancelled'));
@@ -0,0 +1,2 @@
+-- set when a paid order is cancelled and the customer is owed a refund
+ALTER TABLE orders ADD COLUMN needs_refund BOOLEAN NOT NULL DEFAULT false;
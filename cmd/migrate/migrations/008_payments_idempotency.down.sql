@@ -0,0 +1,4 @@
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_status_check;
+DROP INDEX IF EXISTS payments_mpesa_receipt_key;
+DROP INDEX IF EXISTS payments_checkout_request_id_key;
+CREATE INDEX idx_payments_checkout_request_id ON payments(checkout_request_id);
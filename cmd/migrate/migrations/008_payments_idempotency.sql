@@ -0,0 +1,17 @@
+-- drop duplicate confirmations, keeping the first row for each request/receipt
+DELETE FROM payments p
+USING payments o
+WHERE p.checkout_request_id = o.checkout_request_id
+  AND (p.created_at, p.id::text) > (o.created_at, o.id::text);
+
+DELETE FROM payments p
+USING payments o
+WHERE p.mpesa_receipt = o.mpesa_receipt
+  AND (p.created_at, p.id::text) > (o.created_at, o.id::text);
+
+DROP INDEX IF EXISTS idx_payments_checkout_request_id;
+CREATE UNIQUE INDEX payments_checkout_request_id_key ON payments(checkout_request_id);
+CREATE UNIQUE INDEX payments_mpesa_receipt_key ON payments(mpesa_receipt);
+
+ALTER TABLE payments ADD CONSTRAINT payments_status_check
+    CHECK (status IN ('pending', 'success', 'failed'));
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_payments_pending;
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_provider_check;
+ALTER TABLE orders DROP COLUMN IF EXISTS payment_provider;
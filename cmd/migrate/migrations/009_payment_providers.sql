@@ -0,0 +1,10 @@
+-- payment method chosen at checkout
+ALTER TABLE orders
+    ADD COLUMN payment_provider TEXT NOT NULL DEFAULT 'mpesa'
+        CHECK (payment_provider IN ('mpesa', 'card', 'cod'));
+
+-- older rows may carry free-form provider names, so only check new ones
+ALTER TABLE payments ADD CONSTRAINT payments_provider_check
+    CHECK (provider IN ('mpesa', 'card', 'cod')) NOT VALID;
+
+CREATE INDEX idx_payments_pending ON payments(created_at) WHERE status = 'pending';
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS refunds;
+
+UPDATE orders SET status = 'refunded' WHERE status = 'partially_refunded';
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('pending', 'paid', 'shipped', 'delivered', 'completed', 'cancelled', 'refunded'));
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_reviews_product;
+DROP INDEX IF EXISTS idx_products_created_at;
+DROP INDEX IF EXISTS idx_products_price;
+DROP INDEX IF EXISTS idx_products_category;
@@ -0,0 +1,5 @@
+-- support the filters and sort orders of GET /products
+CREATE INDEX IF NOT EXISTS idx_products_category ON products (category_id);
+CREATE INDEX IF NOT EXISTS idx_products_price ON products (price, id);
+CREATE INDEX IF NOT EXISTS idx_products_created_at ON products (created_at DESC, id);
+CREATE INDEX IF NOT EXISTS idx_reviews_product ON reviews (product_id);
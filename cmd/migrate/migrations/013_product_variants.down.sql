@@ -0,0 +1,26 @@
+ALTER TABLE order_items DROP COLUMN IF EXISTS sku, DROP COLUMN IF EXISTS variant_id;
+
+-- lines for different variants of a product merge back into one
+UPDATE cart_items ci
+SET quantity = dup.quantity
+FROM (
+    SELECT cart_id, product_id, SUM(quantity) AS quantity
+    FROM cart_items
+    GROUP BY cart_id, product_id
+    HAVING COUNT(*) > 1
+) dup
+WHERE ci.cart_id = dup.cart_id AND ci.product_id = dup.product_id;
+
+DELETE FROM cart_items ci
+USING cart_items other
+WHERE ci.cart_id = other.cart_id
+  AND ci.product_id = other.product_id
+  AND (ci.created_at, ci.id::text) > (other.created_at, other.id::text);
+
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_cart_id_variant_id_key;
+ALTER TABLE cart_items DROP COLUMN IF EXISTS variant_id;
+ALTER TABLE cart_items ADD CONSTRAINT cart_items_cart_id_product_id_key UNIQUE (cart_id, product_id);
+
+-- products.quantity already holds the variant totals
+DROP TABLE IF EXISTS product_variants;
+DROP FUNCTION IF EXISTS sync_product_quantity();
@@ -0,0 +1,54 @@
+-- sellable variants of a product (size, color, ...), each with its own SKU
+-- and stock; price falls back to the product's when not overridden
+CREATE TABLE product_variants (
+    id UUID PRIMARY KEY,
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku TEXT NOT NULL UNIQUE,
+    options JSONB NOT NULL DEFAULT '{}',
+    price NUMERIC(10,2) CHECK (price > 0),
+    quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (product_id, options)
+);
+
+-- existing products become a single default variant holding their stock
+INSERT INTO product_variants (id, product_id, sku, options, quantity)
+SELECT gen_random_uuid(), id, 'SKU-' || upper(substr(replace(id::text, '-', ''), 1, 12)), '{}', GREATEST(COALESCE(quantity, 0), 0)
+FROM products;
+
+-- products.quantity stays as the total over variants, so listings and the
+-- in-stock filter keep reading a single column
+CREATE FUNCTION sync_product_quantity() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        UPDATE products SET quantity = (
+            SELECT COALESCE(SUM(quantity), 0) FROM product_variants WHERE product_id = OLD.product_id
+        ) WHERE id = OLD.product_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE products SET quantity = (
+            SELECT COALESCE(SUM(quantity), 0) FROM product_variants WHERE product_id = NEW.product_id
+        ) WHERE id = NEW.product_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER product_variants_sync_quantity
+AFTER INSERT OR UPDATE OF quantity, product_id OR DELETE ON product_variants
+FOR EACH ROW EXECUTE FUNCTION sync_product_quantity();
+
+-- cart lines point at variants
+ALTER TABLE cart_items ADD COLUMN variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE;
+UPDATE cart_items ci SET variant_id = v.id FROM product_variants v WHERE v.product_id = ci.product_id;
+DELETE FROM cart_items WHERE variant_id IS NULL;
+ALTER TABLE cart_items ALTER COLUMN variant_id SET NOT NULL;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_cart_id_product_id_key;
+ALTER TABLE cart_items ADD CONSTRAINT cart_items_cart_id_variant_id_key UNIQUE (cart_id, variant_id);
+
+-- order lines keep the SKU they were sold as, even if the variant goes away
+ALTER TABLE order_items
+    ADD COLUMN variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL,
+    ADD COLUMN sku TEXT;
+UPDATE order_items oi SET variant_id = v.id, sku = v.sku FROM product_variants v WHERE v.product_id = oi.product_id;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_categories_parent;
+ALTER TABLE categories
+    DROP CONSTRAINT IF EXISTS categories_slug_key,
+    DROP CONSTRAINT IF EXISTS categories_not_own_parent,
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS slug,
+    DROP COLUMN IF EXISTS parent_id;
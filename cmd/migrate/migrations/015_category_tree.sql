@@ -0,0 +1,35 @@
+-- categories form a tree and are addressed by unique slugs
+ALTER TABLE categories
+    ADD COLUMN parent_id UUID REFERENCES categories(id) ON DELETE RESTRICT,
+    ADD COLUMN slug TEXT,
+    ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD CONSTRAINT categories_not_own_parent CHECK (parent_id <> id);
+
+-- slugs for existing categories, oldest first; like freeSlug in the
+-- category store, a taken slug gets the lowest free numeric suffix, so a
+-- name that already slugifies to "x-2" is never collided with
+DO $$
+DECLARE
+    cat RECORD;
+    base TEXT;
+    candidate TEXT;
+    n INT;
+BEGIN
+    FOR cat IN SELECT id, name FROM categories ORDER BY created_at, id LOOP
+        base := COALESCE(NULLIF(trim(BOTH '-' FROM regexp_replace(lower(cat.name), '[^a-z0-9]+', '-', 'g')), ''), 'category');
+        candidate := base;
+        n := 1;
+        WHILE EXISTS (SELECT 1 FROM categories WHERE slug = candidate) LOOP
+            n := n + 1;
+            candidate := base || '-' || n;
+        END LOOP;
+        UPDATE categories SET slug = candidate WHERE id = cat.id;
+    END LOOP;
+END
+$$;
+
+ALTER TABLE categories
+    ALTER COLUMN slug SET NOT NULL,
+    ADD CONSTRAINT categories_slug_key UNIQUE (slug);
+
+CREATE INDEX idx_categories_parent ON categories (parent_id);
@@ -0,0 +1,5 @@
+-- products are archived instead of deleted so orders keep pointing at them
+ALTER TABLE products ADD COLUMN archived_at TIMESTAMP;
+
+-- the admin list of archived products; listings skip them with a filter
+CREATE INDEX idx_products_archived_at ON products (archived_at DESC, id) WHERE archived_at IS NOT NULL;
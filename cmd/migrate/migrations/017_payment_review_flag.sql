@@ -0,0 +1,3 @@
+-- set on pending payments the reconciler cannot resolve, e.g. when the
+-- provider's reference was never stored, so someone checks them by hand
+ALTER TABLE payments ADD COLUMN needs_review BOOLEAN NOT NULL DEFAULT false;
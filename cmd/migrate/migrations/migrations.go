@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migrations. NNN_name.sql files apply a
+// change and the matching NNN_name.down.sql files, where present, revert it.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -9,15 +9,80 @@ import (
 )
 
 type Config struct {
-	PublicHost             string
-	Port                   string
-	DBUser                 string
-	DBPassword             string
-	DBAddress              string
-	DBName                 string
-	JWTSecret              string
-	JWTExpirationInSeconds int64
-	NodeNotifySecret       string
+	PublicHost                      string
+	Port                            string
+	DBUser                          string
+	DBPassword                      string
+	DBAddress                       string
+	DBName                          string
+	MigrateOnStart                  bool
+	JWTSecret                       string
+	JWTExpirationInSeconds          int64
+	RefreshTokenExpirationInSeconds int64
+	NodeNotifySecret                string
+	NodeNotifySecretPrevious        string
+
+	// links in emails point at the frontend
+	FrontendURL          string
+	RequireVerifiedEmail bool
+
+	MailDriver   string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	MailLogFile  string
+
+	// Daraja (M-Pesa) credentials, the base URL points at sandbox by default
+	MpesaBaseURL        string
+	MpesaConsumerKey    string
+	MpesaConsumerSecret string
+	MpesaShortCode      string
+	MpesaPasskey        string
+	MpesaCallbackURL    string
+	// Daraja cannot sign callbacks, so their URLs carry this as ?token=
+	MpesaCallbackToken string
+
+	// refunds go out as reversals or B2C payments made by an API initiator
+	MpesaInitiatorName      string
+	MpesaSecurityCredential string
+	MpesaB2CShortCode       string
+	MpesaResultURL          string
+	MpesaTimeoutURL         string
+
+	// hosted card gateway, card payments are offered when the URL is set
+	CardGatewayURL            string
+	CardGatewayAPIKey         string
+	CardCurrency              string
+	CardCallbackURL           string
+	CardReturnURL             string
+	CardWebhookSecret         string
+	CardWebhookSecretPrevious string
+
+	// uploaded images go to the local directory or an S3-compatible bucket
+	BlobDriver    string
+	BlobDir       string
+	BlobPublicURL string
+	S3Endpoint    string
+	S3Region      string
+	S3Bucket      string
+	S3AccessKey   string
+	S3SecretKey   string
+	ImageMaxBytes int64
+
+	// largest catalog file accepted by POST /products/import
+	ImportMaxBytes int64
+
+	// payments left pending this long are resolved with an STK query;
+	// an interval of 0 disables the background worker
+	PaymentReconcileAfterMinutes    int64
+	PaymentReconcileIntervalSeconds int64
+
+	// optional first admin, created or promoted on startup
+	AdminName     string
+	AdminEmail    string
+	AdminPassword string
 }
 
 var Envs = initConfig()
@@ -26,15 +91,61 @@ func initConfig() Config {
 	godotenv.Load()
 
 	return Config{
-		PublicHost:             getEnv("PUBLIC_HOST", "http://localhost"),
-		Port:                   getEnv("PORT", "8080"),
-		DBUser:                 getEnv("DB_USER", "root"),
-		DBPassword:             getEnv("DB_PASSWORD", "mypassword"),
-		DBAddress:              fmt.Sprintf("%s:%s", getEnv("DB_HOST", "127.0.0.1"), getEnv("DB_PORT", "3306")),
-		DBName:                 getEnv("DB_NAME", "ecom"),
-		JWTSecret:              getEnv("JWT_SECRET", "not-so-secret-now-is-it?"),
-		JWTExpirationInSeconds: getEnvAsInt("JWT_EXPIRATION_IN_SECONDS", 3600*24*7),
-		NodeNotifySecret:       getEnv("NODE_NOTIFY_SECRET", ""),
+		PublicHost:                      getEnv("PUBLIC_HOST", "http://localhost"),
+		Port:                            getEnv("PORT", "8080"),
+		DBUser:                          getEnv("DB_USER", "root"),
+		DBPassword:                      getEnv("DB_PASSWORD", "mypassword"),
+		DBAddress:                       fmt.Sprintf("%s:%s", getEnv("DB_HOST", "127.0.0.1"), getEnv("DB_PORT", "3306")),
+		DBName:                          getEnv("DB_NAME", "ecom"),
+		MigrateOnStart:                  getEnvAsBool("MIGRATE_ON_START", false),
+		JWTSecret:                       getEnv("JWT_SECRET", "not-so-secret-now-is-it?"),
+		JWTExpirationInSeconds:          getEnvAsInt("JWT_EXPIRATION_IN_SECONDS", 60*15),
+		RefreshTokenExpirationInSeconds: getEnvAsInt("REFRESH_TOKEN_EXPIRATION_IN_SECONDS", 3600*24*30),
+		NodeNotifySecret:                getEnv("NODE_NOTIFY_SECRET", ""),
+		NodeNotifySecretPrevious:        getEnv("NODE_NOTIFY_SECRET_PREVIOUS", ""),
+		FrontendURL:                     getEnv("FRONTEND_URL", "http://localhost:3000"),
+		RequireVerifiedEmail:            getEnvAsBool("REQUIRE_VERIFIED_EMAIL", true),
+		MailDriver:                      getEnv("MAIL_DRIVER", "log"),
+		SMTPHost:                        getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:                        getEnv("SMTP_PORT", "587"),
+		SMTPUsername:                    getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:                    getEnv("SMTP_PASSWORD", ""),
+		MailFrom:                        getEnv("MAIL_FROM", "Executive <no-reply@localhost>"),
+		MailLogFile:                     getEnv("MAIL_LOG_FILE", ""),
+		MpesaBaseURL:                    getEnv("MPESA_BASE_URL", "https://sandbox.safaricom.co.ke"),
+		MpesaConsumerKey:                getEnv("MPESA_CONSUMER_KEY", ""),
+		MpesaConsumerSecret:             getEnv("MPESA_CONSUMER_SECRET", ""),
+		MpesaShortCode:                  getEnv("MPESA_SHORTCODE", "174379"),
+		MpesaPasskey:                    getEnv("MPESA_PASSKEY", ""),
+		MpesaCallbackURL:                getEnv("MPESA_CALLBACK_URL", "http://localhost:8080/api/v1/payments/mpesa/callback"),
+		MpesaCallbackToken:              getEnv("MPESA_CALLBACK_TOKEN", ""),
+		MpesaInitiatorName:              getEnv("MPESA_INITIATOR_NAME", ""),
+		MpesaSecurityCredential:         getEnv("MPESA_SECURITY_CREDENTIAL", ""),
+		MpesaB2CShortCode:               getEnv("MPESA_B2C_SHORTCODE", ""),
+		MpesaResultURL:                  getEnv("MPESA_RESULT_URL", "http://localhost:8080/api/v1/payments/mpesa/refund/result"),
+		MpesaTimeoutURL:                 getEnv("MPESA_TIMEOUT_URL", "http://localhost:8080/api/v1/payments/mpesa/refund/timeout"),
+		CardGatewayURL:                  getEnv("CARD_GATEWAY_URL", ""),
+		CardGatewayAPIKey:               getEnv("CARD_GATEWAY_API_KEY", ""),
+		CardCurrency:                    getEnv("CARD_CURRENCY", "KES"),
+		CardCallbackURL:                 getEnv("CARD_CALLBACK_URL", "http://localhost:8080/api/v1/payments/card/callback"),
+		CardReturnURL:                   getEnv("CARD_RETURN_URL", "http://localhost:3000/orders"),
+		CardWebhookSecret:               getEnv("CARD_WEBHOOK_SECRET", ""),
+		CardWebhookSecretPrevious:       getEnv("CARD_WEBHOOK_SECRET_PREVIOUS", ""),
+		BlobDriver:                      getEnv("BLOB_DRIVER", "local"),
+		BlobDir:                         getEnv("BLOB_DIR", "uploads"),
+		BlobPublicURL:                   getEnv("BLOB_PUBLIC_URL", ""),
+		S3Endpoint:                      getEnv("S3_ENDPOINT", ""),
+		S3Region:                        getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:                        getEnv("S3_BUCKET", ""),
+		S3AccessKey:                     getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:                     getEnv("S3_SECRET_KEY", ""),
+		ImageMaxBytes:                   getEnvAsInt("IMAGE_MAX_BYTES", 10<<20),
+		ImportMaxBytes:                  getEnvAsInt("IMPORT_MAX_BYTES", 32<<20),
+		PaymentReconcileAfterMinutes:    getEnvAsInt("PAYMENT_RECONCILE_AFTER_MINUTES", 5),
+		PaymentReconcileIntervalSeconds: getEnvAsInt("PAYMENT_RECONCILE_INTERVAL_SECONDS", 60),
+		AdminName:                       getEnv("ADMIN_NAME", ""),
+		AdminEmail:                      getEnv("ADMIN_EMAIL", ""),
+		AdminPassword:                   getEnv("ADMIN_PASSWORD", ""),
 	}
 }
 
@@ -59,3 +170,16 @@ func getEnvAsInt(key string, fallback int64) int64 {
 
 	return fallback
 }
+
+func getEnvAsBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fallback
+		}
+
+		return b
+	}
+
+	return fallback
+}
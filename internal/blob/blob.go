@@ -0,0 +1,53 @@
+// Package blob stores uploaded files such as product images, either on the
+// local filesystem or in an S3-compatible bucket.
+package blob
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore saves and removes objects by key and tells where they can be
+// fetched from. Keys are slash-separated paths such as
+// "products/<id>/<image>.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Delete(ctx context.Context, key string) error
+	// URL is the public address of the object
+	URL(key string) string
+}
+
+type Config struct {
+	Driver    string // local or s3
+	PublicURL string // base URL objects are served from
+
+	// local driver
+	Dir string
+
+	// s3 driver; path-style requests work with MinIO and most clones
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// New picks an implementation from cfg. Anything other than "s3" stores
+// files locally, which is what development wants.
+func New(cfg Config) BlobStore {
+	if strings.EqualFold(cfg.Driver, "s3") {
+		return &S3Store{
+			Endpoint:  strings.TrimRight(cfg.Endpoint, "/"),
+			Region:    cfg.Region,
+			Bucket:    cfg.Bucket,
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+			PublicURL: strings.TrimRight(cfg.PublicURL, "/"),
+		}
+	}
+
+	return &LocalStore{Dir: cfg.Dir, PublicURL: strings.TrimRight(cfg.PublicURL, "/")}
+}
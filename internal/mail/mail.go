@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"context"
+	"strings"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password resets.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Config struct {
+	Driver   string // smtp or log
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	LogFile  string // used by the log driver, stdout when empty
+}
+
+// New picks an implementation from cfg. Anything other than "smtp" falls
+// back to the log mailer, which is what local development wants.
+func New(cfg Config) Mailer {
+	if strings.EqualFold(cfg.Driver, "smtp") {
+		return &SMTPMailer{
+			Host:     cfg.Host,
+			Port:     cfg.Port,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			From:     cfg.From,
+		}
+	}
+
+	return &LogMailer{Path: cfg.LogFile}
+}
@@ -3,6 +3,7 @@ import axios from "axios";
 import dotenv from "dotenv";
 import bodyParser from "body-parser";
 import dayjs from "dayjs";
+import crypto from "crypto";
 import jwt from "jsonwebtoken";
 
 dotenv.config();
@@ -51,6 +52,14 @@ async function getAccessToken() {
     return res.data.access_token;
 }
 
+// HMAC-SHA256 of "<timestamp>.<body>", checked by the Go backend
+function signBody(timestamp, body) {
+    return crypto
+        .createHmac("sha256", NODE_NOTIFY_SECRET)
+        .update(`${timestamp}.${body}`)
+        .digest("hex");
+}
+
 // generate Lipa Na Mpesa password
 function lipaPassword() {
     const timestamp = dayjs().format("YYYYMMDDHHmmss");
@@ -186,12 +195,16 @@ app.post("/mpesa/callback", async (req, res) => {
 
         console.log("Notifying Go backend with:", JSON.stringify(notifyPayload, null, 2));
 
+        // sign the exact bytes we send so the Go side can verify them
+        const body = JSON.stringify(notifyPayload);
+        const timestamp = Math.floor(Date.now() / 1000).toString();
         const notifyResponse = await axios.post(
             GO_BACKEND_NOTIFY_URL,
-            notifyPayload,
+            body,
             {
                 headers: {
-                    "X-Node-Notify-Secret": NODE_NOTIFY_SECRET,
+                    "X-Signature": signBody(timestamp, body),
+                    "X-Signature-Timestamp": timestamp,
                     "Content-Type": "application/json"
                 }
             }
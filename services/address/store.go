@@ -28,6 +28,11 @@ func (s *Store) GetAddress(userID uuid.UUID) (*types.Address, error) {
 	return helpers.ScanRowIntoAddress(row)
 }
 
+func (s *Store) GetAddressByID(id uuid.UUID) (*types.Address, error) {
+	row := s.db.QueryRow(`SELECT id, user_id, line1, line2, city, country, zip_code, created_at FROM addresses WHERE id=$1`, id)
+	return helpers.ScanRowIntoAddress(row)
+}
+
 func (s *Store) UpdateAddress(address *types.Address) error {
 	_, err := s.db.Exec(`
 		UPDATE addresses
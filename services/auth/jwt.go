@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -53,26 +54,70 @@ func WithJWTAuth(store types.UserStore) func(http.Handler) http.Handler {
 				return
 			}
 
-			// Optional DB lookup (for verification)
-			_, err = store.GetUserByID(userUUID)
+			// Every access token belongs to a session that can be revoked
+			sid, ok := claims["sid"].(string)
+			if !ok {
+				log.Println("sid claim not found or invalid")
+				permissionDenied(w)
+				return
+			}
+
+			sessionUUID, err := uuid.Parse(sid)
+			if err != nil {
+				log.Printf("failed to parse session UUID: %v", err)
+				permissionDenied(w)
+				return
+			}
+
+			session, err := store.GetSessionByID(sessionUUID)
+			if err != nil || session.UserID != userUUID || !session.Active() {
+				log.Printf("session %s is revoked or unknown: %v", sessionUUID, err)
+				permissionDenied(w)
+				return
+			}
+
+			// DB lookup (for verification); the stored role wins over the
+			// claim so demotions take effect before the token expires
+			user, err := store.GetUserByID(userUUID)
 			if err != nil {
 				log.Printf("user not found: %v", err)
 				permissionDenied(w)
 				return
 			}
 
-			// Add UUID to context
+			// Add UUID, role and session to context
 			ctx := context.WithValue(r.Context(), types.UserKey, userUUID)
+			ctx = context.WithValue(ctx, types.RoleKey, user.Role)
+			ctx = context.WithValue(ctx, types.SessionKey, sessionUUID)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func CreateJWT(secret []byte, userID string) (string, error) {
+// RequireRole must be chained after WithJWTAuth. It rejects requests from
+// users whose role is not one of roles.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := types.RoleFromContext(r.Context())
+			if !slices.Contains(roles, role) {
+				log.Printf("role %q not allowed for %s %s", role, r.Method, r.URL.Path)
+				permissionDenied(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func CreateJWT(secret []byte, userID string, role string, sessionID string) (string, error) {
 	expiration := time.Second * time.Duration(configs.Envs.JWTExpirationInSeconds)
 
 	claims := jwt.MapClaims{
 		"userID": userID,
+		"role":   role,
+		"sid":    sessionID,
 		"exp":    time.Now().Add(expiration).Unix(),
 	}
 
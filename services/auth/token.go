@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/kimenyu/executive/configs"
+)
+
+// NewOpaqueToken returns a random, URL-safe token for refresh tokens and
+// one-off links. Only its HashToken digest should ever be persisted.
+func NewOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken signs token with the JWT secret so a leaked table cannot be
+// used to mint or look up valid tokens.
+func HashToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(configs.Envs.JWTSecret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
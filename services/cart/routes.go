@@ -2,23 +2,27 @@ package cart
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/kimenyu/executive/services/auth"
+	"github.com/kimenyu/executive/services/product"
 	"github.com/kimenyu/executive/types"
 	"github.com/kimenyu/executive/utils"
 )
 
 type Handler struct {
-	store     types.CartStore
-	userStore types.UserStore
+	store        types.CartStore
+	userStore    types.UserStore
+	productStore types.ProductStore
 }
 
-func NewHandler(store types.CartStore, userStore types.UserStore) *Handler {
-	return &Handler{store: store, userStore: userStore}
+func NewHandler(store types.CartStore, userStore types.UserStore, productStore types.ProductStore) *Handler {
+	return &Handler{store: store, userStore: userStore, productStore: productStore}
 }
 
 func (h *Handler) RegisterRoutes(router chi.Router) {
@@ -27,11 +31,14 @@ func (h *Handler) RegisterRoutes(router chi.Router) {
 
 		r.Post("/products/{productID}/cart", h.handleAddItemToCart)
 		r.Get("/cart/my/items", h.handleGetCartItems)
+		r.Patch("/cart/items/{itemID}", h.handleUpdateCartItem)
+		r.Delete("/cart/items/{itemID}", h.handleRemoveCartItem)
+		r.Delete("/cart", h.handleClearCart)
 	})
 }
 
 // @Summary Add product to cart
-// @Description Add a product to the authenticated user's cart
+// @Description Add a product variant to the authenticated user's cart. variant_id may be left out for products with a single variant
 // @Tags Cart
 // @Security BearerAuth
 // @Accept json
@@ -60,6 +67,25 @@ func (h *Handler) handleAddItemToCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	variant, err := product.ResolveVariant(h.productStore, productID, input.VariantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("product not found"))
+		return
+	}
+	if errors.Is(err, product.ErrVariantRequired) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	// Check if cart exists for the user
 	cart, err := h.store.GetCartByUserID(userID)
 	if err == sql.ErrNoRows {
@@ -79,11 +105,12 @@ func (h *Handler) handleAddItemToCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add item to cart
+	// Add item to cart, merging with an existing line for the variant
 	cartItem := &types.CartItem{
 		ID:        uuid.New(),
 		CartID:    cart.ID,
 		ProductID: productID,
+		VariantID: variant.ID,
 		Quantity:  input.Quantity,
 		CreatedAt: time.Now(),
 	}
@@ -95,13 +122,12 @@ func (h *Handler) handleAddItemToCart(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, http.StatusCreated, cartItem)
 }
 
-// @Summary Get my cart items
-// @Description Retrieve items in the authenticated user's cart
+// @Summary Get my cart
+// @Description Retrieve the authenticated user's cart with current prices, line totals and subtotal
 // @Tags Cart
 // @Security BearerAuth
 // @Produce json
-// @Success 200 {array} types.CartItem
-// @Failure 404 {object} map[string]string
+// @Success 200 {object} types.CartView
 // @Failure 500 {object} map[string]string
 // @Router /cart/my/items [get]
 
@@ -109,16 +135,160 @@ func (h *Handler) handleGetCartItems(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(types.UserKey).(uuid.UUID)
 
 	cart, err := h.store.GetCartByUserID(userID)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusOK, &types.CartView{Items: []types.CartItemDetailed{}})
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	view, err := h.store.GetCartView(cart.ID)
 	if err != nil {
-		utils.WriteError(w, http.StatusNotFound, err)
+		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	items, err := h.store.GetCartItems(cart.ID)
+	utils.WriteJSON(w, http.StatusOK, view)
+}
+
+// @Summary Update cart item quantity
+// @Description Set the quantity of a line in the authenticated user's cart
+// @Tags Cart
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param itemID path string true "Cart item UUID"
+// @Param payload body types.UpdateCartItemPayload true "New quantity"
+// @Success 200 {object} types.CartView
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /cart/items/{itemID} [patch]
+
+func (h *Handler) handleUpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	itemID, err := uuid.Parse(chi.URLParam(r, "itemID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid cart item ID"))
+		return
+	}
+
+	var input types.UpdateCartItemPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cart, ok := h.userCart(w, userID)
+	if !ok {
+		return
+	}
+
+	if err := h.store.UpdateCartItemQuantity(cart.ID, itemID, input.Quantity); err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("cart item not found"))
+		return
+	} else if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeCartView(w, cart.ID)
+}
+
+// @Summary Remove cart item
+// @Description Remove a line from the authenticated user's cart
+// @Tags Cart
+// @Security BearerAuth
+// @Produce json
+// @Param itemID path string true "Cart item UUID"
+// @Success 200 {object} types.CartView
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /cart/items/{itemID} [delete]
+
+func (h *Handler) handleRemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	itemID, err := uuid.Parse(chi.URLParam(r, "itemID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid cart item ID"))
+		return
+	}
+
+	cart, ok := h.userCart(w, userID)
+	if !ok {
+		return
+	}
+
+	if err := h.store.RemoveCartItem(cart.ID, itemID); err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("cart item not found"))
+		return
+	} else if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeCartView(w, cart.ID)
+}
+
+// @Summary Clear cart
+// @Description Remove every item from the authenticated user's cart
+// @Tags Cart
+// @Security BearerAuth
+// @Success 204 {object} nil
+// @Failure 500 {object} map[string]string
+// @Router /cart [delete]
+
+func (h *Handler) handleClearCart(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	cart, err := h.store.GetCartByUserID(userID)
+	if err == sql.ErrNoRows {
+		utils.WriteNoContent(w)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.store.ClearCart(cart.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteNoContent(w)
+}
+
+// userCart loads the user's cart, answering 404 when they have none.
+func (h *Handler) userCart(w http.ResponseWriter, userID uuid.UUID) (*types.Cart, bool) {
+	cart, err := h.store.GetCartByUserID(userID)
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("cart item not found"))
+		return nil, false
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return cart, true
+}
+
+func (h *Handler) writeCartView(w http.ResponseWriter, cartID uuid.UUID) {
+	view, err := h.store.GetCartView(cartID)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, items)
+	utils.WriteJSON(w, http.StatusOK, view)
 }
@@ -2,6 +2,8 @@ package cart
 
 import (
 	"database/sql"
+	"encoding/json"
+
 	"github.com/google/uuid"
 	"github.com/kimenyu/executive/types"
 )
@@ -32,14 +34,23 @@ func (s *Store) CreateCart(cart *types.Cart) error {
 }
 
 func (s *Store) AddCartItem(item *types.CartItem) error {
-	_, err := s.db.Exec(`INSERT INTO cart_items(id, cart_id, product_id, quantity, created_at)
-		VALUES($1, $2, $3, $4, $5)`,
-		item.ID, item.CartID, item.ProductID, item.Quantity, item.CreatedAt)
-	return err
+	// adding a variant that is already in the cart bumps the existing line
+	row := s.db.QueryRow(`INSERT INTO cart_items(id, cart_id, product_id, variant_id, quantity, created_at)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (cart_id, variant_id)
+		DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
+		RETURNING id, quantity, created_at`,
+		item.ID, item.CartID, item.ProductID, item.VariantID, item.Quantity, item.CreatedAt)
+	return row.Scan(&item.ID, &item.Quantity, &item.CreatedAt)
 }
 
 func (s *Store) GetCartItems(cartID uuid.UUID) ([]types.CartItem, error) {
-	rows, err := s.db.Query(`SELECT id, cart_id, product_id, quantity, created_at FROM cart_items WHERE cart_id = $1`, cartID)
+	// lines for archived products stay hidden until the cart is cleared,
+	// so they come back if the product is restored
+	rows, err := s.db.Query(`SELECT ci.id, ci.cart_id, ci.product_id, ci.variant_id, ci.quantity, ci.created_at
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = $1 AND p.archived_at IS NULL`, cartID)
 	if err != nil {
 		return nil, err
 	}
@@ -48,11 +59,87 @@ func (s *Store) GetCartItems(cartID uuid.UUID) ([]types.CartItem, error) {
 	var items []types.CartItem
 	for rows.Next() {
 		var item types.CartItem
-		if err := rows.Scan(&item.ID, &item.CartID, &item.ProductID, &item.Quantity, &item.CreatedAt); err != nil {
+		if err := rows.Scan(&item.ID, &item.CartID, &item.ProductID, &item.VariantID, &item.Quantity, &item.CreatedAt); err != nil {
 			return nil, err
 		}
 		items = append(items, item)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	return items, nil
 }
+
+func (s *Store) GetCartView(cartID uuid.UUID) (*types.CartView, error) {
+	rows, err := s.db.Query(`
+		SELECT ci.id, ci.product_id, v.id, v.sku, v.options, p.name, COALESCE(p.image, ''),
+		       COALESCE(v.price, p.price), ci.quantity,
+		       COALESCE(v.price, p.price) * ci.quantity, v.quantity >= ci.quantity
+		FROM cart_items ci
+		JOIN product_variants v ON v.id = ci.variant_id
+		JOIN products p ON p.id = v.product_id
+		WHERE ci.cart_id = $1 AND p.archived_at IS NULL
+		ORDER BY ci.created_at, ci.id`, cartID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	view := &types.CartView{CartID: cartID, Items: []types.CartItemDetailed{}, Subtotal: types.NewMoney(0)}
+	for rows.Next() {
+		var item types.CartItemDetailed
+		var options []byte
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.SKU, &options, &item.ProductName, &item.Image,
+			&item.UnitPrice, &item.Quantity, &item.LineTotal, &item.InStock); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(options, &item.Options); err != nil {
+			return nil, err
+		}
+		view.Items = append(view.Items, item)
+		view.Subtotal = view.Subtotal.Add(item.LineTotal)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return view, nil
+}
+
+// UpdateCartItemQuantity sets the quantity of a line in the given cart.
+// Scoping by cart keeps users from touching other people's carts. Lines
+// for archived products read as sql.ErrNoRows, as in ResolveVariant.
+func (s *Store) UpdateCartItemQuantity(cartID, itemID uuid.UUID, quantity int) error {
+	res, err := s.db.Exec(`UPDATE cart_items ci SET quantity = $1
+		FROM products p
+		WHERE ci.id = $2 AND ci.cart_id = $3 AND p.id = ci.product_id AND p.archived_at IS NULL`, quantity, itemID, cartID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *Store) RemoveCartItem(cartID, itemID uuid.UUID) error {
+	res, err := s.db.Exec(`DELETE FROM cart_items WHERE id = $1 AND cart_id = $2`, itemID, cartID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *Store) ClearCart(cartID uuid.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM cart_items WHERE cart_id = $1`, cartID)
+	return err
+}
+
+func expectOneRow(res sql.Result) error {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
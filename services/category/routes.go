@@ -1,29 +1,41 @@
 package category
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/kimenyu/executive/services/auth"
 	"github.com/kimenyu/executive/types"
 	"github.com/kimenyu/executive/utils"
 )
 
 type Handler struct {
-	store types.CategoryStore
+	store     types.CategoryStore
+	userStore types.UserStore
 }
 
-func NewHandler(store types.CategoryStore) *Handler {
-	return &Handler{store: store}
+func NewHandler(store types.CategoryStore, userStore types.UserStore) *Handler {
+	return &Handler{store: store, userStore: userStore}
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Route("/categories", func(r chi.Router) {
 		r.Get("/", h.handleGetCategories)
+		r.Get("/tree", h.handleGetCategoryTree)
 		r.Get("/{id}", h.handleGetCategory)
-		r.Post("/", h.handleCreateCategory)
 
+		r.Group(func(r chi.Router) {
+			r.Use(auth.WithJWTAuth(h.userStore))
+			r.Use(auth.RequireRole(types.RoleAdmin, types.RoleStaff))
+			r.Post("/", h.handleCreateCategory)
+			r.Put("/{id}", h.handleUpdateCategory)
+			r.Delete("/{id}", h.handleDeleteCategory)
+		})
 	})
 }
 
@@ -35,7 +47,10 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 // @Param category body types.CreateCategoryPayload true "Category to create"
 // @Success 201 {object} types.Category
 // @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
 // @Failure 500 {object} map[string]string
+// @Security BearerAuth
 // @Router /categories/ [post]
 
 func (h *Handler) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
@@ -46,15 +61,23 @@ func (h *Handler) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
 
+	now := time.Now()
 	category := &types.Category{
 		ID:        uuid.New(),
+		ParentID:  input.ParentID,
 		Name:      input.Name,
-		CreatedAt: time.Now(),
+		Slug:      input.Slug,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
 	if err := h.store.CreateCategory(category); err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, categoryStatus(err), err)
 		return
 	}
 
@@ -79,27 +102,168 @@ func (h *Handler) handleGetCategories(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, http.StatusOK, categories)
 }
 
-// @Summary Get category by ID
-// @Description Retrieve a single category by its UUID
+// @Summary Get the category tree
+// @Description Retrieve all categories nested under their parents, ordered by name
 // @Tags Categories
 // @Produce json
-// @Param id path string true "Category UUID"
+// @Success 200 {array} types.CategoryNode
+// @Failure 500 {object} map[string]string
+// @Router /categories/tree [get]
+
+func (h *Handler) handleGetCategoryTree(w http.ResponseWriter, r *http.Request) {
+	categories, err := h.store.GetCategories()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, buildTree(categories))
+}
+
+// buildTree nests categories under their parents. Categories are expected
+// in name order, which the children keep.
+func buildTree(categories []*types.Category) []*types.CategoryNode {
+	nodes := make(map[uuid.UUID]*types.CategoryNode, len(categories))
+	for _, c := range categories {
+		nodes[c.ID] = &types.CategoryNode{Category: *c, Children: []*types.CategoryNode{}}
+	}
+
+	roots := make([]*types.CategoryNode, 0)
+	for _, c := range categories {
+		node := nodes[c.ID]
+		if parent, ok := nodes[c.ParentID.UUID]; c.ParentID.Valid && ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// @Summary Get category by ID or slug
+// @Description Retrieve a single category by its UUID or slug
+// @Tags Categories
+// @Produce json
+// @Param id path string true "Category UUID or slug"
 // @Success 200 {object} types.Category
-// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /categories/{id} [get]
 
 func (h *Handler) handleGetCategory(w http.ResponseWriter, r *http.Request) {
-	categoryIDStr := chi.URLParam(r, "id")
-	categoryUUID, err := uuid.Parse(categoryIDStr)
+	key := chi.URLParam(r, "id")
+
+	var category *types.Category
+	var err error
+	if id, parseErr := uuid.Parse(key); parseErr == nil {
+		category, err = h.store.GetCategoryById(id)
+	} else {
+		category, err = h.store.GetCategoryBySlug(key)
+	}
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
+		utils.WriteError(w, categoryStatus(err), notFound(err))
+		return
 	}
 
-	category, err := h.store.GetCategoryById(categoryUUID)
+	utils.WriteJSON(w, http.StatusOK, category)
+}
+
+// @Summary Update a category
+// @Description Rename a category, change its slug or move it under another parent (null for top level). An empty slug keeps the current one.
+// @Tags Categories
+// @Accept json
+// @Produce json
+// @Param id path string true "Category UUID"
+// @Param category body types.CreateCategoryPayload true "New category fields"
+// @Success 200 {object} types.Category
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /categories/{id} [put]
+
+func (h *Handler) handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid category ID"))
+		return
+	}
+
+	var input types.CreateCategoryPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	category := &types.Category{
+		ID:       id,
+		ParentID: input.ParentID,
+		Name:     input.Name,
+		Slug:     input.Slug,
+	}
+	if err := h.store.UpdateCategory(category); err != nil {
+		utils.WriteError(w, categoryStatus(err), notFound(err))
+		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, category)
 }
+
+// @Summary Delete a category
+// @Description Delete a category. policy decides what happens to its subcategories and products: restrict (default) refuses while there are any, reparent moves both to the parent, detach moves subcategories to the parent and leaves products uncategorised.
+// @Tags Categories
+// @Param id path string true "Category UUID"
+// @Param policy query string false "restrict, reparent or detach"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /categories/{id} [delete]
+
+func (h *Handler) handleDeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid category ID"))
+		return
+	}
+
+	policy := r.URL.Query().Get("policy")
+	if policy == "" {
+		policy = types.CategoryDeleteRestrict
+	}
+
+	if err := h.store.DeleteCategory(id, policy); err != nil {
+		utils.WriteError(w, categoryStatus(err), notFound(err))
+		return
+	}
+
+	utils.WriteNoContent(w)
+}
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("category not found")
+	}
+	return err
+}
+
+// categoryStatus maps category store errors to an HTTP status.
+func categoryStatus(err error) int {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, ErrParentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnknownPolicy):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrDuplicateSlug), errors.Is(err, ErrCategoryCycle), errors.Is(err, ErrCategoryInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -1,10 +1,26 @@
 package category
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/google/uuid"
-	"github.com/kimenyu/executive/helpers"
 	"github.com/kimenyu/executive/types"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateSlug   = errors.New("slug already in use")
+	ErrParentNotFound  = errors.New("parent category not found")
+	ErrCategoryCycle   = errors.New("a category cannot be moved under itself or its subcategories")
+	ErrCategoryInUse   = errors.New("category still has subcategories or products")
+	ErrUnknownPolicy   = errors.New("policy must be restrict, reparent or detach")
+	errSlugUnavailable = errors.New("no free slug")
 )
 
 type Store struct {
@@ -15,15 +31,140 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
-// create a category
+const categoryColumns = `id, parent_id, name, slug, created_at, updated_at`
+
+func scanCategory(row interface{ Scan(...any) error }) (*types.Category, error) {
+	c := new(types.Category)
+	err := row.Scan(&c.ID, &c.ParentID, &c.Name, &c.Slug, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify turns a name into a URL slug, "Home & Garden" into "home-garden".
+func Slugify(name string) string {
+	slug := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		return "category"
+	}
+	return slug
+}
+
+// slugAttempts bounds how often CreateCategory derives a slug again after
+// a concurrent insert took the one it picked.
+const slugAttempts = 5
+
+// create a category. Without a slug one is derived from the name, numbered
+// when already taken; an explicit slug that is taken is an error.
 func (s *Store) CreateCategory(category *types.Category) error {
-	_, err := s.db.Exec(`INSERT INTO categories(id, name, created_at) VALUES($1, $2, $3)`, category.ID, category.Name, category.CreatedAt)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if category.Slug != "" {
+		return s.insertCategory(ctx, category, false)
+	}
+
+	var err error
+	for range slugAttempts {
+		err = s.insertCategory(ctx, category, true)
+		if !errors.Is(err, ErrDuplicateSlug) {
+			return err
+		}
+		category.Slug = ""
+	}
+	return err
+}
+
+// insertCategory inserts category in its own transaction, deriving the slug
+// first when derive is set. A failed insert aborts the transaction, so a
+// retry needs a new one.
+func (s *Store) insertCategory(ctx context.Context, category *types.Category, derive bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkParent(ctx, tx, category.ParentID); err != nil {
+		return err
+	}
+	if derive {
+		if category.Slug, err = freeSlug(ctx, tx, Slugify(category.Name)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO categories(id, parent_id, name, slug, created_at, updated_at)
+VALUES($1, $2, $3, $4, $5, $6)`, category.ID, category.ParentID, category.Name, category.Slug, category.CreatedAt, category.UpdatedAt)
+	if err != nil {
+		return slugError(err)
+	}
+	return tx.Commit()
+}
+
+// freeSlug returns base, or base with the lowest free numeric suffix.
+func freeSlug(ctx context.Context, tx *sql.Tx, base string) (string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT slug FROM categories WHERE slug = $1 OR slug LIKE $2`,
+		base, base+"-%")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return "", err
+		}
+		taken[slug] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if !taken[base] {
+		return base, nil
+	}
+	for n := 2; n <= len(taken)+1; n++ {
+		if slug := fmt.Sprintf("%s-%d", base, n); !taken[slug] {
+			return slug, nil
+		}
+	}
+	return "", errSlugUnavailable
+}
+
+// checkParent makes sure a non-null parent exists.
+func checkParent(ctx context.Context, tx *sql.Tx, parentID uuid.NullUUID) error {
+	if !parentID.Valid {
+		return nil
+	}
+	var exists bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM categories WHERE id = $1)`, parentID.UUID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrParentNotFound
+	}
+	return nil
+}
+
+// slugError turns a unique violation on the slug into ErrDuplicateSlug.
+func slugError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "categories_slug_key" {
+		return ErrDuplicateSlug
+	}
 	return err
 }
 
 // get all categories
 func (s *Store) GetCategories() ([]*types.Category, error) {
-	rows, err := s.db.Query("SELECT  * from categories")
+	rows, err := s.db.Query(`SELECT ` + categoryColumns + ` FROM categories ORDER BY name, id`)
 	if err != nil {
 		return nil, err
 	}
@@ -33,7 +174,7 @@ func (s *Store) GetCategories() ([]*types.Category, error) {
 	categories := make([]*types.Category, 0)
 
 	for rows.Next() {
-		c, err := helpers.ScanRowsIntoCategories(rows)
+		c, err := scanCategory(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -41,11 +182,126 @@ func (s *Store) GetCategories() ([]*types.Category, error) {
 		categories = append(categories, c)
 	}
 
-	return categories, nil
+	return categories, rows.Err()
 }
 
 // get category by id
 func (s *Store) GetCategoryById(id uuid.UUID) (*types.Category, error) {
-	row := s.db.QueryRow("SELECT * FROM categories WHERE id=$1", id)
-	return helpers.ScanRowIntoCategory(row)
+	row := s.db.QueryRow(`SELECT `+categoryColumns+` FROM categories WHERE id = $1`, id)
+	return scanCategory(row)
+}
+
+// get category by slug
+func (s *Store) GetCategoryBySlug(slug string) (*types.Category, error) {
+	row := s.db.QueryRow(`SELECT `+categoryColumns+` FROM categories WHERE slug = $1`, slug)
+	return scanCategory(row)
+}
+
+// UpdateCategory renames and moves a category. An empty slug keeps the
+// current one. Moves are serialised so two concurrent moves cannot close a
+// cycle between them.
+func (s *Store) UpdateCategory(category *types.Category) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	current, err := scanCategory(tx.QueryRowContext(ctx,
+		`SELECT `+categoryColumns+` FROM categories WHERE id = $1`, category.ID))
+	if err != nil {
+		return err
+	}
+
+	if err := checkParent(ctx, tx, category.ParentID); err != nil {
+		return err
+	}
+	if category.ParentID.Valid {
+		// the new parent must not be the category or one of its descendants
+		var cycle bool
+		err := tx.QueryRowContext(ctx, `WITH RECURSIVE sub AS (
+	SELECT id FROM categories WHERE id = $1
+	UNION ALL
+	SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id
+) SELECT EXISTS(SELECT 1 FROM sub WHERE id = $2)`, category.ID, category.ParentID.UUID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	if category.Slug == "" {
+		category.Slug = current.Slug
+	}
+	category.CreatedAt = current.CreatedAt
+
+	err = tx.QueryRowContext(ctx, `UPDATE categories
+SET name = $1, slug = $2, parent_id = $3, updated_at = CURRENT_TIMESTAMP
+WHERE id = $4
+RETURNING updated_at`, category.Name, category.Slug, category.ParentID, category.ID).Scan(&category.UpdatedAt)
+	if err != nil {
+		return slugError(err)
+	}
+	return tx.Commit()
+}
+
+// DeleteCategory deletes a category, handling its subcategories and
+// products according to policy, one of the types.CategoryDelete constants.
+func (s *Store) DeleteCategory(id uuid.UUID, policy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var parentID uuid.NullUUID
+	err = tx.QueryRowContext(ctx, `SELECT parent_id FROM categories WHERE id = $1 FOR UPDATE`, id).Scan(&parentID)
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case types.CategoryDeleteRestrict:
+		var inUse bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM categories WHERE parent_id = $1)
+	OR EXISTS(SELECT 1 FROM products WHERE category_id = $1)`, id).Scan(&inUse)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return ErrCategoryInUse
+		}
+	case types.CategoryDeleteReparent, types.CategoryDeleteDetach:
+		if _, err := tx.ExecContext(ctx, `UPDATE categories SET parent_id = $1, updated_at = CURRENT_TIMESTAMP
+WHERE parent_id = $2`, parentID, id); err != nil {
+			return err
+		}
+		productCategory := uuid.NullUUID{}
+		if policy == types.CategoryDeleteReparent {
+			productCategory = parentID
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE products SET category_id = $1, updated_at = CURRENT_TIMESTAMP
+WHERE category_id = $2`, productCategory, id); err != nil {
+			return err
+		}
+	default:
+		return ErrUnknownPolicy
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM categories WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,92 @@
+package order
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/services/product"
+	"github.com/kimenyu/executive/types"
+)
+
+var (
+	ErrProductUnavailable = errors.New("product unavailable")
+	ErrInsufficientStock  = errors.New("insufficient stock")
+	ErrTotalMismatch      = errors.New("order total mismatch")
+)
+
+// priceItems prices the requested items from the catalog. Lines for the same
+// variant are merged, unknown products and quantities above the available
+// stock are rejected, and the total is computed here, never by the client.
+func priceItems(products types.ProductStore, orderID uuid.UUID, requested []types.CreateOrderItemDTO) ([]types.OrderItem, types.Money, error) {
+	quantities := make(map[uuid.UUID]int)
+	variants := make(map[uuid.UUID]*types.ProductVariant)
+	var order []uuid.UUID
+	for _, item := range requested {
+		variant, err := product.ResolveVariant(products, item.ProductID, item.VariantID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, types.Money{}, fmt.Errorf("%w: product %s does not exist", ErrProductUnavailable, item.ProductID)
+		}
+		if errors.Is(err, product.ErrVariantRequired) {
+			return nil, types.Money{}, fmt.Errorf("%w: product %s", err, item.ProductID)
+		}
+		if err != nil {
+			return nil, types.Money{}, err
+		}
+
+		if _, seen := variants[variant.ID]; !seen {
+			order = append(order, variant.ID)
+			variants[variant.ID] = variant
+		}
+		quantities[variant.ID] += item.Quantity
+	}
+
+	items := make([]types.OrderItem, 0, len(order))
+	total := types.NewMoney(0)
+	for _, variantID := range order {
+		variant := variants[variantID]
+
+		quantity := quantities[variantID]
+		if variant.Quantity < quantity {
+			return nil, types.Money{}, fmt.Errorf("%w: only %d of %s left", ErrInsufficientStock, variant.Quantity, variant.SKU)
+		}
+
+		items = append(items, types.OrderItem{
+			ID:        uuid.New(),
+			OrderID:   orderID,
+			ProductID: variant.ProductID,
+			VariantID: variant.ID,
+			SKU:       variant.SKU,
+			Quantity:  quantity,
+			Price:     variant.Price,
+		})
+		total = total.Add(variant.Price.Mul(int64(quantity)))
+	}
+
+	return items, total, nil
+}
+
+// checkClientTotal compares the total a client expected to pay with the one
+// computed from the catalog. A zero client total skips the check.
+func checkClientTotal(clientTotal, total types.Money) error {
+	if clientTotal.IsZero() || clientTotal.Equal(total) {
+		return nil
+	}
+	return fmt.Errorf("%w: expected %s but prices add up to %s", ErrTotalMismatch, clientTotal, total)
+}
+
+// pricingStatus maps pricing errors to an HTTP status.
+func pricingStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrProductUnavailable):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, product.ErrVariantRequired):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInsufficientStock), errors.Is(err, ErrTotalMismatch):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
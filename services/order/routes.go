@@ -1,13 +1,17 @@
 package order
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/kimenyu/executive/configs"
 	"github.com/kimenyu/executive/services/auth"
 	"github.com/kimenyu/executive/types"
 	"github.com/kimenyu/executive/utils"
@@ -17,20 +21,26 @@ type Handler struct {
 	store        types.OrderStore
 	userStore    types.UserStore
 	addressStore types.AddressStore
+	productStore types.ProductStore
+	cartStore    types.CartStore
 }
 
-func NewHandler(store types.OrderStore, userStore types.UserStore, addressStore types.AddressStore) *Handler {
-	return &Handler{store: store, userStore: userStore, addressStore: addressStore}
+func NewHandler(store types.OrderStore, userStore types.UserStore, addressStore types.AddressStore, productStore types.ProductStore, cartStore types.CartStore) *Handler {
+	return &Handler{store: store, userStore: userStore, addressStore: addressStore, productStore: productStore, cartStore: cartStore}
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Group(func(r chi.Router) {
 		r.Use(auth.WithJWTAuth(h.userStore))
 		r.Post("/orders", h.handleCreateOrder)
+		r.Post("/cart/checkout", h.handleCheckout)
 		r.Get("/orders", h.handleGetOrdersByUser)
 		r.Get("/orders/{orderID}", h.handleGetOrderByID)
-		r.Patch("/orders/{id}", h.handleUpdateOrder)
+		r.Post("/orders/{orderID}/cancel", h.handleCancelOrder)
 
+		// status transitions are back-office only
+		r.With(auth.RequireRole(types.RoleAdmin, types.RoleStaff)).
+			Patch("/orders/{id}", h.handleUpdateOrder)
 	})
 }
 
@@ -43,64 +53,171 @@ func (h *Handler) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate items
-	if len(input.Items) == 0 {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("order must contain at least one item"))
+	if !h.checkEmailVerified(w, userID) {
 		return
 	}
 
-	// Calculate total
-	var total float64
-	for _, item := range input.Items {
-		if item.Quantity <= 0 {
-			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("quantity for product %s must be greater than 0", item.ProductID))
-			return
-		}
-		if item.Price <= 0 {
-			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("price for product %s must be greater than 0", item.ProductID))
-			return
-		}
-		total += float64(item.Quantity) * item.Price
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
 	}
 
 	address, err := h.addressStore.GetAddress(userID)
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("add a delivery address before placing an order"))
+		return
+	}
+
+	orderID := uuid.New()
+	items, total, err := priceItems(h.productStore, orderID, input.Items)
+	if err != nil {
+		utils.WriteError(w, pricingStatus(err), err)
+		return
+	}
+
+	if err := checkClientTotal(input.Total, total); err != nil {
+		utils.WriteError(w, pricingStatus(err), err)
+		return
 	}
 
 	// Create order
 	order := &types.Order{
-		ID:        uuid.New(),
+		ID:        orderID,
 		UserID:    userID,
 		AddressID: address.ID,
 		Total:     total,
-		Status:    "pending",
+		Status:    types.OrderStatusPending,
 		CreatedAt: time.Now(),
+
+		PaymentProvider: input.PaymentProvider,
 	}
 
-	if err := h.store.CreateOrder(order); err != nil {
+	// Insert order and items and reserve stock in one transaction
+	if err := h.store.PlaceOrder(order, items); err != nil {
+		utils.WriteError(w, pricingStatus(err), err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, order)
+}
+
+// handleCheckout turns the authenticated user's cart into an order shipped
+// to one of their addresses, then empties the cart.
+func (h *Handler) handleCheckout(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	var input types.CheckoutPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !h.checkEmailVerified(w, userID) {
+		return
+	}
+
+	address, err := h.addressStore.GetAddressByID(input.AddressID)
+	if err == sql.ErrNoRows || (err == nil && address.UserID != userID) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("address not found"))
+		return
+	}
+	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	// Add order items
-	for _, item := range input.Items {
-		orderItem := &types.OrderItem{
-			ID:        uuid.New(),
-			OrderID:   order.ID,
+	cart, err := h.cartStore.GetCartByUserID(userID)
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("cart is empty"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	cartItems, err := h.cartStore.GetCartItems(cart.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(cartItems) == 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("cart is empty"))
+		return
+	}
+
+	requested := make([]types.CreateOrderItemDTO, 0, len(cartItems))
+	for _, item := range cartItems {
+		requested = append(requested, types.CreateOrderItemDTO{
 			ProductID: item.ProductID,
+			VariantID: uuid.NullUUID{UUID: item.VariantID, Valid: true},
 			Quantity:  item.Quantity,
-			Price:     item.Price,
-		}
-		if err := h.store.AddOrderItem(orderItem); err != nil {
-			utils.WriteError(w, http.StatusInternalServerError, err)
-			return
-		}
+		})
+	}
+
+	orderID := uuid.New()
+	items, total, err := priceItems(h.productStore, orderID, requested)
+	if err != nil {
+		utils.WriteError(w, pricingStatus(err), err)
+		return
+	}
+
+	if err := checkClientTotal(input.Total, total); err != nil {
+		utils.WriteError(w, pricingStatus(err), err)
+		return
+	}
+
+	order := &types.Order{
+		ID:        orderID,
+		UserID:    userID,
+		AddressID: address.ID,
+		Total:     total,
+		Status:    types.OrderStatusPending,
+		CreatedAt: time.Now(),
+
+		PaymentProvider: input.PaymentProvider,
+	}
+
+	if err := h.store.PlaceOrder(order, items); err != nil {
+		utils.WriteError(w, pricingStatus(err), err)
+		return
+	}
+
+	// the order stands even if this fails; the user can clear the cart later
+	if err := h.cartStore.ClearCart(cart.ID); err != nil {
+		log.Printf("clearing cart %s after order %s failed: %v", cart.ID, order.ID, err)
 	}
 
 	utils.WriteJSON(w, http.StatusCreated, order)
 }
 
+// checkEmailVerified blocks checkout for unverified accounts when
+// REQUIRE_VERIFIED_EMAIL is on, and only logs them otherwise.
+func (h *Handler) checkEmailVerified(w http.ResponseWriter, userID uuid.UUID) bool {
+	user, err := h.userStore.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return true
+	}
+
+	if configs.Envs.RequireVerifiedEmail {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("verify your email address before checking out"))
+		return false
+	}
+
+	log.Printf("checkout by unverified user %s", userID)
+	return true
+}
+
 func (h *Handler) handleGetOrdersByUser(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(types.UserKey).(uuid.UUID)
 
@@ -124,6 +241,10 @@ func (h *Handler) handleGetOrderByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	order, err := h.store.GetOrderWithItemsByID(orderID)
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found"))
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
@@ -142,7 +263,66 @@ func (h *Handler) handleGetOrderByID(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, http.StatusOK, order)
 }
 
+// handleCancelOrder lets customers cancel their own orders until they ship.
+func (h *Handler) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	orderID, err := uuid.Parse(chi.URLParam(r, "orderID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	// the reason is optional, so an empty body is fine
+	var input types.CancelOrderPayload
+	if r.ContentLength > 0 {
+		if err := utils.ParseJSON(r, &input); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	order, err := h.store.GetOrderWithItemsByID(orderID)
+	if err == sql.ErrNoRows || (err == nil && order.Order.UserID != userID) {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := order.Order.Status
+	if status != types.OrderStatusPending && status != types.OrderStatusPaid {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("an order that is %s can no longer be cancelled", status))
+		return
+	}
+
+	note := "cancelled by customer"
+	if input.Reason != "" {
+		note += ": " + input.Reason
+	}
+
+	// the state machine re-checks the status under a row lock, so an order
+	// shipped in the meantime is rejected here
+	_, err = h.store.TransitionOrderStatus(orderID, types.OrderStatusCancelled, uuid.NullUUID{UUID: userID, Valid: true}, note)
+	if err != nil {
+		utils.WriteError(w, transitionStatus(err), err)
+		return
+	}
+
+	order, err = h.store.GetOrderWithItemsByID(orderID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, order)
+}
+
 func (h *Handler) handleUpdateOrder(w http.ResponseWriter, r *http.Request) {
+	actorID := r.Context().Value(types.UserKey).(uuid.UUID)
+
 	idParam := chi.URLParam(r, "id")
 	orderID, err := uuid.Parse(idParam)
 	if err != nil {
@@ -156,17 +336,34 @@ func (h *Handler) handleUpdateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order, err := h.store.GetOrderWithItemsByID(orderID)
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, err = h.store.TransitionOrderStatus(orderID, p.Status, uuid.NullUUID{UUID: actorID, Valid: true}, p.Note)
 	if err != nil {
-		utils.WriteError(w, http.StatusNotFound, err)
+		utils.WriteError(w, transitionStatus(err), err)
 		return
 	}
 
-	order.Order.Status = p.Status
-	if err := h.store.UpdateOrder(&order.Order); err != nil {
+	order, err := h.store.GetOrderWithItemsByID(orderID)
+	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, order)
 }
+
+// transitionStatus maps TransitionOrderStatus errors to an HTTP status.
+func transitionStatus(err error) int {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidTransition):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,45 @@
+package order
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/kimenyu/executive/types"
+)
+
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// transitions lists, for every status, the statuses an order may move to.
+// Statuses without an entry are final.
+var transitions = map[string][]string{
+	types.OrderStatusPending:   {types.OrderStatusPaid, types.OrderStatusCancelled},
+	types.OrderStatusPaid:      {types.OrderStatusShipped, types.OrderStatusCancelled, types.OrderStatusRefunded},
+	types.OrderStatusShipped:   {types.OrderStatusDelivered},
+	types.OrderStatusDelivered: {types.OrderStatusCompleted, types.OrderStatusRefunded, types.OrderStatusPartiallyRefunded},
+	types.OrderStatusCompleted: {types.OrderStatusRefunded, types.OrderStatusPartiallyRefunded},
+	// only delivered orders are partly refunded, so fulfilment never
+	// moves backwards from here
+	types.OrderStatusPartiallyRefunded: {
+		types.OrderStatusCompleted, types.OrderStatusRefunded, types.OrderStatusPartiallyRefunded,
+	},
+}
+
+// CanTransition reports whether an order in status from may move to to.
+func CanTransition(from, to string) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// cash on delivery orders ship before they are paid; the payment is
+// recorded when they are delivered
+var cashOnDeliveryTransitions = map[string][]string{
+	types.OrderStatusPending: {types.OrderStatusShipped},
+}
+
+// CanTransitionOrder is CanTransition with the extra moves allowed by the
+// order's payment method.
+func CanTransitionOrder(o *types.Order, to string) bool {
+	if o.PaymentProvider == types.PaymentProviderCOD && slices.Contains(cashOnDeliveryTransitions[o.Status], to) {
+		return true
+	}
+	return CanTransition(o.Status, to)
+}
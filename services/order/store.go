@@ -1,15 +1,20 @@
 package order
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kimenyu/executive/types"
 )
 
+const orderColumns = "o.id, o.user_id, o.total, o.status, o.address_id, o.created_at, COALESCE(o.updated_at, o.created_at), o.needs_refund, o.payment_provider"
+
 type Store struct {
 	db *sql.DB
 }
@@ -18,22 +23,75 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
-func (s *Store) CreateOrder(order *types.Order) error {
-	_, err := s.db.Exec(`INSERT INTO orders (id, user_id, total, status, address_id, created_at) 
-		VALUES ($1, $2, $3, $4, $5, $6)`,
-		order.ID, order.UserID, order.Total, order.Status, order.AddressID, order.CreatedAt)
-	return err
-}
+func (s *Store) PlaceOrder(order *types.Order, items []types.OrderItem) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-func (s *Store) AddOrderItem(item *types.OrderItem) error {
-	_, err := s.db.Exec(`INSERT INTO order_items (id, order_id, product_id, quantity, price) 
-		VALUES ($1, $2, $3, $4, $5)`,
-		item.ID, item.OrderID, item.ProductID, item.Quantity, item.Price)
-	return err
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order.UpdatedAt = order.CreatedAt
+	if order.PaymentProvider == "" {
+		order.PaymentProvider = types.PaymentProviderMpesa
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO orders (id, user_id, total, status, address_id, created_at, updated_at, payment_provider) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		order.ID, order.UserID, order.Total, order.Status, order.AddressID, order.CreatedAt, order.UpdatedAt, order.PaymentProvider)
+	if err != nil {
+		return err
+	}
+
+	actor := uuid.NullUUID{UUID: order.UserID, Valid: true}
+	if err := insertStatusChange(ctx, tx, order.ID, "", order.Status, actor, "order placed"); err != nil {
+		return err
+	}
+
+	// decrement in a fixed order so concurrent checkouts of overlapping
+	// carts lock rows in the same sequence and cannot deadlock. Sorting by
+	// product first also orders the product rows the stock trigger updates.
+	sorted := slices.Clone(items)
+	slices.SortFunc(sorted, func(a, b types.OrderItem) int {
+		return cmp.Or(
+			strings.Compare(a.ProductID.String(), b.ProductID.String()),
+			strings.Compare(a.VariantID.String(), b.VariantID.String()),
+		)
+	})
+
+	for _, item := range sorted {
+		// the conditional update takes the row lock, so a concurrent order
+		// sees the decremented quantity and fails instead of overselling
+		res, err := tx.ExecContext(ctx, `UPDATE product_variants
+			SET quantity = quantity - $1, updated_at = $2
+			WHERE id = $3 AND quantity >= $1`,
+			item.Quantity, time.Now(), item.VariantID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("%w: %s", ErrInsufficientStock, item.SKU)
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO order_items (id, order_id, product_id, variant_id, sku, quantity, price) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			item.ID, order.ID, item.ProductID, item.VariantID, item.SKU, item.Quantity, item.Price)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 func (s *Store) GetOrdersByUser(userID uuid.UUID) ([]types.Order, error) {
-	rows, err := s.db.Query(`SELECT id, user_id, total, status, address_id, created_at FROM orders WHERE user_id = $1`, userID)
+	rows, err := s.db.Query(`SELECT `+orderColumns+` FROM orders o WHERE o.user_id = $1 ORDER BY o.created_at DESC`, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +100,7 @@ func (s *Store) GetOrdersByUser(userID uuid.UUID) ([]types.Order, error) {
 	var orders []types.Order
 	for rows.Next() {
 		var o types.Order
-		if err := rows.Scan(&o.ID, &o.UserID, &o.Total, &o.Status, &o.AddressID, &o.CreatedAt); err != nil {
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Total, &o.Status, &o.AddressID, &o.CreatedAt, &o.UpdatedAt, &o.NeedsRefund, &o.PaymentProvider); err != nil {
 			return nil, err
 		}
 		orders = append(orders, o)
@@ -53,8 +111,8 @@ func (s *Store) GetOrdersByUser(userID uuid.UUID) ([]types.Order, error) {
 func (s *Store) GetOrderWithItemsByID(orderID uuid.UUID) (*types.OrderWithItems, error) {
 	query := `
 		SELECT 
-			o.id, o.user_id, o.total, o.status, o.address_id, o.created_at,
-			oi.id, oi.product_id, oi.quantity, oi.price,
+			` + orderColumns + `,
+			oi.id, oi.product_id, oi.variant_id, COALESCE(oi.sku, ''), oi.quantity, oi.price,
 			p.name
 		FROM orders o
 		LEFT JOIN order_items oi ON o.id = oi.order_id
@@ -76,15 +134,17 @@ func (s *Store) GetOrderWithItemsByID(orderID uuid.UUID) (*types.OrderWithItems,
 		var (
 			itemID      sql.NullString
 			productID   sql.NullString
+			variantID   uuid.NullUUID
+			sku         string
 			quantity    sql.NullInt32
-			price       sql.NullFloat64
+			price       types.Money
 			productName sql.NullString
 		)
 
 		if firstRow {
 			if err := rows.Scan(
-				&order.ID, &order.UserID, &order.Total, &order.Status, &order.AddressID, &order.CreatedAt,
-				&itemID, &productID, &quantity, &price,
+				&order.ID, &order.UserID, &order.Total, &order.Status, &order.AddressID, &order.CreatedAt, &order.UpdatedAt, &order.NeedsRefund, &order.PaymentProvider,
+				&itemID, &productID, &variantID, &sku, &quantity, &price,
 				&productName,
 			); err != nil {
 				return nil, err
@@ -92,20 +152,22 @@ func (s *Store) GetOrderWithItemsByID(orderID uuid.UUID) (*types.OrderWithItems,
 			firstRow = false
 		} else {
 			var dummyOrderID, dummyUserID, dummyAddressID string
-			var dummyTotal float64
+			var dummyTotal types.Money
 			var dummyStatus string
-			var dummyCreatedAt time.Time
+			var dummyCreatedAt, dummyUpdatedAt time.Time
+			var dummyNeedsRefund bool
+			var dummyPaymentProvider string
 
 			if err := rows.Scan(
-				&dummyOrderID, &dummyUserID, &dummyTotal, &dummyStatus, &dummyAddressID, &dummyCreatedAt,
-				&itemID, &productID, &quantity, &price,
+				&dummyOrderID, &dummyUserID, &dummyTotal, &dummyStatus, &dummyAddressID, &dummyCreatedAt, &dummyUpdatedAt, &dummyNeedsRefund, &dummyPaymentProvider,
+				&itemID, &productID, &variantID, &sku, &quantity, &price,
 				&productName,
 			); err != nil {
 				return nil, err
 			}
 		}
 
-		if itemID.Valid && productID.Valid && quantity.Valid && price.Valid {
+		if itemID.Valid && productID.Valid && quantity.Valid {
 			oiID, err := uuid.Parse(itemID.String)
 			if err != nil {
 				return nil, fmt.Errorf("invalid order item id: %v", err)
@@ -118,9 +180,11 @@ func (s *Store) GetOrderWithItemsByID(orderID uuid.UUID) (*types.OrderWithItems,
 			item := types.OrderItemDetailed{
 				ID:          oiID,
 				ProductID:   pID,
+				VariantID:   variantID,
+				SKU:         sku,
 				ProductName: productName.String,
 				Quantity:    int(quantity.Int32),
-				Price:       price.Float64,
+				Price:       price,
 			}
 			items = append(items, item)
 		}
@@ -130,27 +194,156 @@ func (s *Store) GetOrderWithItemsByID(orderID uuid.UUID) (*types.OrderWithItems,
 		return nil, sql.ErrNoRows
 	}
 
+	history, err := s.getStatusHistory(orderID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &types.OrderWithItems{
-		Order: order,
-		Items: items,
+		Order:   order,
+		Items:   items,
+		History: history,
 	}, nil
 }
 
-func (s *Store) UpdateOrder(o *types.Order) error {
+func (s *Store) getStatusHistory(orderID uuid.UUID) ([]types.OrderStatusChange, error) {
+	rows, err := s.db.Query(`
+		SELECT id, COALESCE(from_status, ''), to_status, actor_id, COALESCE(note, ''), created_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY created_at, id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []types.OrderStatusChange{}
+	for rows.Next() {
+		var c types.OrderStatusChange
+		if err := rows.Scan(&c.ID, &c.FromStatus, &c.ToStatus, &c.ActorID, &c.Note, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+func (s *Store) TransitionOrderStatus(orderID uuid.UUID, status string, actorID uuid.NullUUID, note string) (*types.Order, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	query := `
-        UPDATE orders
-        SET status = $1, updated_at = $2
-        WHERE id = $3
-    `
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// lock the order so concurrent transitions are applied one at a time
+	var o types.Order
+	err = tx.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders o WHERE o.id = $1 FOR UPDATE`, orderID).
+		Scan(&o.ID, &o.UserID, &o.Total, &o.Status, &o.AddressID, &o.CreatedAt, &o.UpdatedAt, &o.NeedsRefund, &o.PaymentProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	if !CanTransitionOrder(&o, status) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, o.Status, status)
+	}
+
+	from := o.Status
+	o.Status = status
+	o.UpdatedAt = time.Now()
+
+	if status == types.OrderStatusCancelled {
+		// put the reserved quantities back on the shelf; lines whose
+		// variant was deleted since have nowhere to go
+		_, err = tx.ExecContext(ctx, `UPDATE product_variants v
+			SET quantity = v.quantity + r.quantity, updated_at = $1
+			FROM (
+				SELECT variant_id, SUM(quantity) AS quantity
+				FROM order_items
+				WHERE order_id = $2 AND variant_id IS NOT NULL
+				GROUP BY variant_id
+			) r
+			WHERE r.variant_id = v.id`, o.UpdatedAt, o.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if from == types.OrderStatusPaid {
+			o.NeedsRefund = true
+		}
+	}
+
+	if status == types.OrderStatusDelivered && o.PaymentProvider == types.PaymentProviderCOD {
+		if err := recordCashPayment(ctx, tx, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET status = $1, updated_at = $2, needs_refund = $3 WHERE id = $4`,
+		o.Status, o.UpdatedAt, o.NeedsRefund, o.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := s.db.ExecContext(ctx, query, o.Status, time.Now(), o.ID)
+	if err := insertStatusChange(ctx, tx, o.ID, from, o.Status, actorID, note); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// recordCashPayment settles a cash on delivery order once the courier has
+// handed it over, completing the pending payment or recording a new one.
+func recordCashPayment(ctx context.Context, tx *sql.Tx, o *types.Order) error {
+	res, err := tx.ExecContext(ctx, `UPDATE payments SET status = $1
+		WHERE id = (
+			SELECT id FROM payments
+			WHERE order_id = $2 AND provider = $3 AND status = $4
+			ORDER BY created_at
+			LIMIT 1
+		)`, types.PaymentStatusSuccess, o.ID, types.PaymentProviderCOD, types.PaymentStatusPending)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected > 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO payments (id, order_id, amount, provider, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		uuid.New(), o.ID, o.Total, types.PaymentProviderCOD, types.PaymentStatusSuccess, time.Now())
 	return err
 }
 
-func (s *Store) UpdateOrderStatus(orderID uuid.UUID, status string) error {
-	_, err := s.db.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, status, orderID)
+// SetPaymentProvider changes the payment method of an order that has not
+// been paid yet.
+func (s *Store) SetPaymentProvider(orderID uuid.UUID, provider string) error {
+	res, err := s.db.Exec(`UPDATE orders SET payment_provider = $1, updated_at = $2 WHERE id = $3 AND status = $4`,
+		provider, time.Now(), orderID, types.OrderStatusPending)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func insertStatusChange(ctx context.Context, tx *sql.Tx, orderID uuid.UUID, from, to string, actorID uuid.NullUUID, note string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO order_status_history (id, order_id, from_status, to_status, actor_id, note, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7)`,
+		uuid.New(), orderID, from, to, actorID, note, time.Now())
 	return err
 }
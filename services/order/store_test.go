@@ -0,0 +1,146 @@
+package order_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/cmd/migrate/migrations"
+	"github.com/kimenyu/executive/internal/migrate"
+	"github.com/kimenyu/executive/services/address"
+	"github.com/kimenyu/executive/services/category"
+	"github.com/kimenyu/executive/services/order"
+	"github.com/kimenyu/executive/services/product"
+	"github.com/kimenyu/executive/services/user"
+	"github.com/kimenyu/executive/types"
+	_ "github.com/lib/pq"
+)
+
+// testDB connects to TEST_DATABASE_URL and migrates it. The database is
+// written to, so never point it at one you care about.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	m, err := migrate.New(conn, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background(), 0); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	return conn
+}
+
+func TestPlaceOrderConcurrent(t *testing.T) {
+	const buyers = 20
+
+	conn := testDB(t)
+	conn.SetMaxOpenConns(buyers + 1)
+	now := time.Now()
+	suffix := uuid.NewString()[:8]
+
+	customer := &types.User{ID: uuid.New(), Name: "Buyer", Email: "buyer-" + suffix + "@example.com", Password: "x", CreatedAt: now, UpdatedAt: now}
+	if err := user.NewStore(conn).CreateUser(customer); err != nil {
+		t.Fatal(err)
+	}
+	addr := &types.Address{ID: uuid.New(), UserID: customer.ID, Line1: "1 Moi Avenue", City: "Nairobi", Country: "KE", ZipCode: "00100", CreatedAt: now}
+	if err := address.NewStore(conn).CreateAddress(addr); err != nil {
+		t.Fatal(err)
+	}
+	cat := &types.Category{ID: uuid.New(), Name: "Concurrency " + suffix, CreatedAt: now, UpdatedAt: now}
+	if err := category.NewStore(conn).CreateCategory(cat); err != nil {
+		t.Fatal(err)
+	}
+
+	// one unit left, every buyer wants it
+	prod := &types.Product{
+		ID:         uuid.New(),
+		Name:       "Last one " + suffix,
+		Price:      types.NewMoney(150000),
+		CategoryID: cat.ID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Variants:   []types.ProductVariant{{SKU: "LAST-" + suffix, Quantity: 1}},
+	}
+	if err := product.NewStore(conn).CreateProduct(prod); err != nil {
+		t.Fatal(err)
+	}
+	variant := prod.Variants[0]
+
+	store := order.NewStore(conn)
+	errs := make([]error, buyers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range buyers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			o := &types.Order{
+				ID:        uuid.New(),
+				UserID:    customer.ID,
+				Total:     prod.Price,
+				Status:    types.OrderStatusPending,
+				AddressID: addr.ID,
+				CreatedAt: time.Now(),
+			}
+			errs[i] = store.PlaceOrder(o, []types.OrderItem{{
+				ID:        uuid.New(),
+				ProductID: prod.ID,
+				VariantID: variant.ID,
+				SKU:       variant.SKU,
+				Quantity:  1,
+				Price:     prod.Price,
+			}})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	placed := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			placed++
+		case !errors.Is(err, order.ErrInsufficientStock):
+			t.Errorf("buyer %d: %v, want success or insufficient stock", i, err)
+		}
+	}
+	if placed != 1 {
+		t.Errorf("%d orders placed for one unit of stock, want exactly 1", placed)
+	}
+
+	var variantQty, productQty, orders int
+	err := conn.QueryRow(`SELECT v.quantity, p.quantity FROM product_variants v JOIN products p ON p.id = v.product_id
+		WHERE v.id = $1`, variant.ID).Scan(&variantQty, &productQty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variantQty != 0 || productQty != 0 {
+		t.Errorf("stock left: variant %d, product %d, want 0", variantQty, productQty)
+	}
+
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM orders WHERE user_id = $1`, customer.ID).Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 1 {
+		t.Errorf("%d orders stored, want 1; failed checkouts must roll back", orders)
+	}
+}
@@ -0,0 +1,181 @@
+// Package card is a client for a generic hosted card gateway: the API
+// creates a charge, the customer pays on the gateway's checkout page, and
+// the gateway reports the result to a signed webhook.
+//
+// The protocol, in amounts of minor currency units:
+//
+//	POST /charges               {amount, currency, reference, description, callback_url, return_url}
+//	GET  /charges/{id}
+//	POST /charges/{id}/refunds  {amount, reason}
+//
+// Charges and refunds have a status of pending, succeeded or failed.
+// Webhooks post {"type": "charge.updated", "data": <charge>}.
+package card
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+type Config struct {
+	BaseURL     string
+	APIKey      string
+	Currency    string
+	CallbackURL string
+	ReturnURL   string
+	HTTPClient  *http.Client
+}
+
+type Client struct {
+	cfg  Config
+	http *http.Client
+}
+
+func NewClient(cfg Config) *Client {
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if cfg.Currency == "" {
+		cfg.Currency = "KES"
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &Client{cfg: cfg, http: httpClient}
+}
+
+type Charge struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Reference   string `json:"reference"`
+	CheckoutURL string `json:"checkout_url"`
+}
+
+type Refund struct {
+	ID       string `json:"id"`
+	ChargeID string `json:"charge_id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+}
+
+type Event struct {
+	Type string `json:"type"`
+	Data Charge `json:"data"`
+}
+
+// APIError is an error response from the gateway.
+type APIError struct {
+	StatusCode int
+	Message    string `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("card gateway: %d: %s", e.StatusCode, e.Message)
+}
+
+// CreateCharge starts a charge for amount minor units. reference is echoed
+// back on the charge and its webhooks.
+func (c *Client) CreateCharge(ctx context.Context, amount int64, reference, description string) (*Charge, error) {
+	var out Charge
+	err := c.do(ctx, http.MethodPost, "/charges", map[string]any{
+		"amount":       amount,
+		"currency":     c.cfg.Currency,
+		"reference":    reference,
+		"description":  description,
+		"callback_url": c.cfg.CallbackURL,
+		"return_url":   c.cfg.ReturnURL,
+	}, &out)
+	if err != nil {
+		return nil, fmt.Errorf("card charge: %w", err)
+	}
+	return &out, nil
+}
+
+func (c *Client) GetCharge(ctx context.Context, id string) (*Charge, error) {
+	var out Charge
+	if err := c.do(ctx, http.MethodGet, "/charges/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, fmt.Errorf("card charge %s: %w", id, err)
+	}
+	return &out, nil
+}
+
+func (c *Client) CreateRefund(ctx context.Context, chargeID string, amount int64, reason string) (*Refund, error) {
+	var out Refund
+	err := c.do(ctx, http.MethodPost, "/charges/"+url.PathEscape(chargeID)+"/refunds", map[string]any{
+		"amount": amount,
+		"reason": reason,
+	}, &out)
+	if err != nil {
+		return nil, fmt.Errorf("card refund: %w", err)
+	}
+	return &out, nil
+}
+
+// ParseEvent decodes a webhook body.
+func ParseEvent(body []byte) (*Event, error) {
+	var ev Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, fmt.Errorf("card webhook: %w", err)
+	}
+	if ev.Data.ID == "" {
+		return nil, fmt.Errorf("card webhook: missing charge")
+	}
+	return &ev, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.BaseURL+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: res.StatusCode}
+		if json.Unmarshal(b, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(b))
+		}
+		return apiErr
+	}
+
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,279 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/services/payment/card"
+	"github.com/kimenyu/executive/types"
+)
+
+const (
+	testCardAPIKey        = "card-api-key"
+	testCardWebhookSecret = "card-webhook-secret"
+)
+
+// fakeGateway is a card gateway that keeps charges in memory.
+type fakeGateway struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	charges map[string]*card.Charge
+	created []map[string]any
+	// outcome of new charges: pending (default), succeeded or declined
+	outcome string
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	g := &fakeGateway{charges: map[string]*card.Charge{}}
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+testCardAPIKey {
+				writeTestJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid API key"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Post("/charges", func(w http.ResponseWriter, r *http.Request) {
+		var in map[string]any
+		json.NewDecoder(r.Body).Decode(&in)
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.created = append(g.created, in)
+
+		if g.outcome == "declined" {
+			writeTestJSON(w, http.StatusPaymentRequired, map[string]string{"error": "card declined"})
+			return
+		}
+
+		amount, _ := in["amount"].(float64)
+		charge := &card.Charge{
+			ID:          "ch_" + strconv.Itoa(len(g.created)),
+			Status:      card.StatusPending,
+			Amount:      int64(amount),
+			Currency:    in["currency"].(string),
+			Reference:   in["reference"].(string),
+			CheckoutURL: "https://gateway.example/checkout/" + strconv.Itoa(len(g.created)),
+		}
+		if g.outcome == card.StatusSucceeded {
+			charge.Status = card.StatusSucceeded
+		}
+		g.charges[charge.ID] = charge
+		writeTestJSON(w, http.StatusCreated, charge)
+	})
+	r.Get("/charges/{id}", func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		charge, ok := g.charges[chi.URLParam(r, "id")]
+		if !ok {
+			writeTestJSON(w, http.StatusNotFound, map[string]string{"error": "no such charge"})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, charge)
+	})
+
+	g.Server = httptest.NewServer(r)
+	t.Cleanup(g.Close)
+	return g
+}
+
+// settle changes a charge's status as the customer finishing checkout
+// would, and returns it.
+func (g *fakeGateway) settle(id, status string) card.Charge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.charges[id].Status = status
+	return *g.charges[id]
+}
+
+func newCardTest(t *testing.T, webhookSecret string) *paymentTest {
+	previous := configs.Envs.CardWebhookSecret
+	configs.Envs.CardWebhookSecret = webhookSecret
+	t.Cleanup(func() { configs.Envs.CardWebhookSecret = previous })
+
+	gateway := newFakeGateway(t)
+	client := card.NewClient(card.Config{
+		BaseURL:     gateway.URL,
+		APIKey:      testCardAPIKey,
+		CallbackURL: "https://shop.example/api/v1/payments/card/callback",
+		ReturnURL:   "https://shop.example/orders",
+		HTTPClient:  &http.Client{Timeout: time.Second},
+	})
+
+	tt := newPaymentTest(NewCardProvider(client))
+	tt.gateway = gateway
+	return tt
+}
+
+// payByCard starts a card payment for the order as its owner.
+func (tt *paymentTest) payByCard() *httptest.ResponseRecorder {
+	return tt.as("/orders/{orderID}/pay", tt.h.handlePay, "/orders/"+tt.order.ID.String()+"/pay", `{}`)
+}
+
+// webhook posts a charge event signed with key at timestamp.
+func (tt *paymentTest) webhook(charge card.Charge, key string, timestamp time.Time) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(card.Event{Type: "charge.updated", Data: charge})
+	req := httptest.NewRequest(http.MethodPost, "/payments/card/callback", bytes.NewReader(body))
+	if key != "" {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, Sign([]byte(key), ts, body))
+	}
+	return tt.serve(req)
+}
+
+func TestCardCharge(t *testing.T) {
+	tt := newCardTest(t, testCardWebhookSecret)
+
+	rec := tt.payByCard()
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var out struct {
+		Payment     types.Payment `json:"payment"`
+		RedirectURL string        `json:"redirect_url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.RedirectURL != "https://gateway.example/checkout/1" {
+		t.Errorf("redirect_url %q, want the gateway's checkout page", out.RedirectURL)
+	}
+
+	pay := tt.payment(t, out.Payment.ID)
+	if pay.Status != types.PaymentStatusPending || pay.CheckoutRequestID != "ch_1" {
+		t.Errorf("payment %+v, want pending on charge ch_1", pay)
+	}
+
+	sent := tt.gateway.created[0]
+	if sent["amount"] != float64(100050) || sent["currency"] != "KES" {
+		t.Errorf("charged %v %v, want 100050 KES in minor units", sent["amount"], sent["currency"])
+	}
+	if sent["reference"] != pay.ID.String() || sent["callback_url"] != "https://shop.example/api/v1/payments/card/callback" {
+		t.Errorf("charge reference %v, callback %v", sent["reference"], sent["callback_url"])
+	}
+}
+
+func TestCardChargeDeclined(t *testing.T) {
+	tt := newCardTest(t, testCardWebhookSecret)
+	tt.gateway.outcome = "declined"
+
+	rec := tt.payByCard()
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadGateway, rec.Body)
+	}
+
+	if _, err := tt.store.GetPendingPayment(tt.order.ID, types.PaymentProviderCard); err == nil {
+		t.Errorf("declined charge left a pending payment")
+	}
+	if got := tt.orders.status(tt.order.ID); got != types.OrderStatusPending {
+		t.Errorf("order %s, want pending", got)
+	}
+}
+
+func TestCardChargeSucceededAtOnce(t *testing.T) {
+	tt := newCardTest(t, testCardWebhookSecret)
+	tt.gateway.outcome = card.StatusSucceeded
+
+	if rec := tt.payByCard(); rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	pay, err := tt.store.GetCapturedPayment(tt.order.ID)
+	if err != nil {
+		t.Fatalf("no captured payment: %v", err)
+	}
+	if pay.MpesaReceipt != "ch_1" {
+		t.Errorf("receipt %q, want the charge ID", pay.MpesaReceipt)
+	}
+	if got := tt.orders.status(tt.order.ID); got != types.OrderStatusPaid {
+		t.Errorf("order %s, want paid", got)
+	}
+}
+
+func TestCardWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     string // status in the webhook
+		amount    int64
+		gateway   string // status the gateway reports when asked
+		wantPay   string
+		wantOrder string
+	}{
+		{"succeeded", card.StatusSucceeded, 100050, card.StatusSucceeded, types.PaymentStatusSuccess, types.OrderStatusPaid},
+		{"failed", card.StatusFailed, 100050, card.StatusFailed, types.PaymentStatusFailed, types.OrderStatusPending},
+		{"wrong amount", card.StatusSucceeded, 100000, card.StatusSucceeded, types.PaymentStatusPending, types.OrderStatusPending},
+		{"not confirmed", card.StatusSucceeded, 100050, card.StatusPending, types.PaymentStatusPending, types.OrderStatusPending},
+		{"pending", card.StatusPending, 100050, card.StatusPending, types.PaymentStatusPending, types.OrderStatusPending},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newCardTest(t, testCardWebhookSecret)
+			if rec := tt.payByCard(); rec.Code != http.StatusAccepted {
+				t.Fatalf("pay: status %d: %s", rec.Code, rec.Body)
+			}
+			pay, _ := tt.store.GetPendingPayment(tt.order.ID, types.PaymentProviderCard)
+
+			charge := tt.gateway.settle(pay.CheckoutRequestID, tc.gateway)
+			charge.Status, charge.Amount = tc.event, tc.amount
+
+			if rec := tt.webhook(charge, testCardWebhookSecret, time.Now()); rec.Code != http.StatusOK {
+				t.Fatalf("webhook: status %d: %s", rec.Code, rec.Body)
+			}
+
+			if got := tt.payment(t, pay.ID); got.Status != tc.wantPay {
+				t.Errorf("payment %s, want %s", got.Status, tc.wantPay)
+			}
+			if got := tt.orders.status(tt.order.ID); got != tc.wantOrder {
+				t.Errorf("order %s, want %s", got, tc.wantOrder)
+			}
+		})
+	}
+}
+
+func TestCardWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		key        string
+		at         time.Time
+		want       int
+	}{
+		{"unsigned", testCardWebhookSecret, "", time.Now(), http.StatusUnauthorized},
+		{"wrong key", testCardWebhookSecret, "guess", time.Now(), http.StatusUnauthorized},
+		{"stale", testCardWebhookSecret, testCardWebhookSecret, time.Now().Add(-time.Hour), http.StatusUnauthorized},
+		{"not configured", "", testCardWebhookSecret, time.Now(), http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newCardTest(t, tc.configured)
+			if rec := tt.payByCard(); rec.Code != http.StatusAccepted {
+				t.Fatalf("pay: status %d: %s", rec.Code, rec.Body)
+			}
+			pay, _ := tt.store.GetPendingPayment(tt.order.ID, types.PaymentProviderCard)
+			charge := tt.gateway.settle(pay.CheckoutRequestID, card.StatusSucceeded)
+
+			if rec := tt.webhook(charge, tc.key, tc.at); rec.Code != tc.want {
+				t.Fatalf("status %d, want %d", rec.Code, tc.want)
+			}
+			if got := tt.payment(t, pay.ID); got.Status != types.PaymentStatusPending {
+				t.Errorf("payment %s after a rejected webhook", got.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/types"
+)
+
+const testNotifySecret = "notify-secret"
+
+// confirm posts a signed payment confirmation, as the Node service does.
+func (tt *paymentTest) confirm(body map[string]any) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/payments/confirm", bytes.NewReader(b))
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, Sign([]byte(testNotifySecret), ts, b))
+	return tt.serve(req)
+}
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		name      string
+		amount    string
+		provider  string
+		want      int
+		wantOrder string
+	}{
+		// the order total of 1000.50 is charged as 1001 on M-Pesa
+		{"rounded up M-Pesa charge", "1001", types.PaymentProviderMpesa, http.StatusOK, types.OrderStatusPaid},
+		{"order total on M-Pesa", "1000.50", types.PaymentProviderMpesa, http.StatusBadRequest, types.OrderStatusPending},
+		{"unknown provider", "1001", "paypal", http.StatusBadRequest, types.OrderStatusPending},
+		{"provider not enabled", "1000.50", types.PaymentProviderCard, http.StatusBadRequest, types.OrderStatusPending},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			previous := configs.Envs.NodeNotifySecret
+			configs.Envs.NodeNotifySecret = testNotifySecret
+			t.Cleanup(func() { configs.Envs.NodeNotifySecret = previous })
+			tt := newMpesaTest(t, testCallbackToken)
+
+			rec := tt.confirm(map[string]any{
+				"order_id":            tt.order.ID.String(),
+				"status":              types.PaymentStatusSuccess,
+				"amount":              tc.amount,
+				"provider":            tc.provider,
+				"checkout_request_id": "ws_CO_node",
+				"mpesa_receipt":       "RCPTNODE",
+			})
+			if rec.Code != tc.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+			if got := tt.orders.status(tt.order.ID); got != tc.wantOrder {
+				t.Errorf("order %s, want %s", got, tc.wantOrder)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/types"
+)
+
+// memStore is an in-memory types.PaymentStore with the same pending-only
+// transitions as Store. Successful payments are applied to orders.
+type memStore struct {
+	orders *memOrders
+
+	mu       sync.Mutex
+	payments map[uuid.UUID]*types.Payment
+	refunds  map[uuid.UUID]*types.Refund
+}
+
+func newMemStore() *memStore {
+	return &memStore{payments: map[uuid.UUID]*types.Payment{}, refunds: map[uuid.UUID]*types.Refund{}}
+}
+
+func (s *memStore) CreatePayment(p *types.Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *p
+	s.payments[p.ID] = &cp
+	return nil
+}
+
+func (s *memStore) find(match func(*types.Payment) bool) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.payments {
+		if match(p) {
+			cp := *p
+			return &cp, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) GetPaymentByID(id uuid.UUID) (*types.Payment, error) {
+	return s.find(func(p *types.Payment) bool { return p.ID == id })
+}
+
+func (s *memStore) GetPaymentByCheckoutID(checkout string) (*types.Payment, error) {
+	return s.find(func(p *types.Payment) bool { return p.CheckoutRequestID == checkout })
+}
+
+func (s *memStore) GetPaymentByReceipt(receipt string) (*types.Payment, error) {
+	return s.find(func(p *types.Payment) bool { return receipt != "" && p.MpesaReceipt == receipt })
+}
+
+func (s *memStore) UpsertPayment(p *types.Payment) (*types.Payment, bool, error) {
+	existing, err := s.GetPaymentByCheckoutID(p.CheckoutRequestID)
+	if err == sql.ErrNoRows {
+		if err := s.CreatePayment(p); err != nil {
+			return nil, false, err
+		}
+		if p.Status == types.PaymentStatusSuccess {
+			s.orders.paid(p.OrderID)
+		}
+		return p, true, nil
+	}
+	if existing.Status != types.PaymentStatusPending || p.Status == types.PaymentStatusPending {
+		return existing, false, nil
+	}
+	existing.Status = p.Status
+	existing.MpesaReceipt = p.MpesaReceipt
+	if err := s.CreatePayment(existing); err != nil {
+		return nil, false, err
+	}
+	if existing.Status == types.PaymentStatusSuccess {
+		s.orders.paid(existing.OrderID)
+	}
+	return existing, true, nil
+}
+
+func (s *memStore) CompletePayment(p *types.Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.payments[p.ID]
+	if !ok || stored.Status != types.PaymentStatusPending {
+		return sql.ErrNoRows
+	}
+	stored.Status = p.Status
+	stored.MpesaReceipt = p.MpesaReceipt
+	if p.Phone != "" {
+		stored.Phone = p.Phone
+	}
+	stored.Metadata = p.Metadata
+	if p.Status == types.PaymentStatusSuccess {
+		s.orders.paid(p.OrderID)
+	}
+	return nil
+}
+
+func (s *memStore) SetCheckoutRequest(id uuid.UUID, checkoutRequestID, merchantRequestID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payments[id].CheckoutRequestID = checkoutRequestID
+	s.payments[id].MerchantRequestID = merchantRequestID
+	return nil
+}
+
+func (s *memStore) GetPendingPayment(orderID uuid.UUID, provider string) (*types.Payment, error) {
+	return s.find(func(p *types.Payment) bool {
+		return p.OrderID == orderID && p.Provider == provider && p.Status == types.PaymentStatusPending && !p.NeedsReview
+	})
+}
+
+func (s *memStore) FlagPaymentForReview(id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.payments[id]; ok && p.Status == types.PaymentStatusPending {
+		p.NeedsReview = true
+	}
+	return nil
+}
+
+func (s *memStore) ListStalePendingPayments(cutoff time.Time, providers []string, limit int) ([]types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stale []types.Payment
+	for _, p := range s.payments {
+		if p.Status == types.PaymentStatusPending && !p.NeedsReview && p.CreatedAt.Before(cutoff) && slices.Contains(providers, p.Provider) {
+			stale = append(stale, *p)
+		}
+	}
+	if len(stale) > limit {
+		stale = stale[:limit]
+	}
+	return stale, nil
+}
+
+func (s *memStore) GetCapturedPayment(orderID uuid.UUID) (*types.Payment, error) {
+	return s.find(func(p *types.Payment) bool { return p.OrderID == orderID && p.Status == types.PaymentStatusSuccess })
+}
+
+func (s *memStore) CreateRefund(r *types.Refund) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pay, ok := s.payments[r.PaymentID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if pay.Status != types.PaymentStatusSuccess {
+		return ErrPaymentNotCaptured
+	}
+
+	left := pay.Amount
+	for _, other := range s.refunds {
+		if other.PaymentID == r.PaymentID && other.Status != types.PaymentStatusFailed {
+			left = left.Sub(other.Amount)
+		}
+	}
+	if r.Amount.IsZero() {
+		r.Amount = left
+	}
+	if r.Amount.Amount <= 0 || r.Amount.Amount > left.Amount {
+		return ErrRefundExceedsPayment
+	}
+
+	r.Status = types.PaymentStatusPending
+	r.UpdatedAt = r.CreatedAt
+	cp := *r
+	s.refunds[r.ID] = &cp
+	return nil
+}
+
+func (s *memStore) SetRefundReference(id uuid.UUID, reference string, amount types.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refunds[id].ProviderReference = reference
+	s.refunds[id].Amount = amount
+	return nil
+}
+
+func (s *memStore) CompleteRefund(id uuid.UUID, status string, metadata json.RawMessage) (*types.Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.refunds[id]
+	if !ok || r.Status != types.PaymentStatusPending {
+		return nil, sql.ErrNoRows
+	}
+	r.Status = status
+	if metadata != nil {
+		r.Metadata = metadata
+	}
+	cp := *r
+	return &cp, nil
+}
+
+func (s *memStore) GetRefundByReference(reference string) (*types.Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.refunds {
+		if reference != "" && r.ProviderReference == reference {
+			cp := *r
+			return &cp, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) refund(id uuid.UUID) types.Refund {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.refunds[id]
+}
+
+func (s *memStore) ListRefundsByOrder(orderID uuid.UUID) ([]types.Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refunds := []types.Refund{}
+	for _, r := range s.refunds {
+		if r.OrderID == orderID {
+			refunds = append(refunds, *r)
+		}
+	}
+	return refunds, nil
+}
+
+func (s *memStore) RefundTotals(orderID uuid.UUID) (captured, refunded types.Money, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.payments {
+		if p.OrderID == orderID && p.Status == types.PaymentStatusSuccess {
+			captured = captured.Add(p.Amount)
+		}
+	}
+	for _, r := range s.refunds {
+		if r.OrderID == orderID && r.Status == types.PaymentStatusSuccess {
+			refunded = refunded.Add(r.Amount)
+		}
+	}
+	return captured, refunded, nil
+}
+
+func (s *memStore) ClearNeedsRefund(orderID uuid.UUID) error { return nil }
+
+// memOrders keeps the orders a payment test works with. Methods payments
+// never call are left to the embedded nil interface.
+type memOrders struct {
+	types.OrderStore
+
+	mu     sync.Mutex
+	orders map[uuid.UUID]*types.Order
+	moves  []string
+}
+
+func newMemOrders(orders ...types.Order) *memOrders {
+	s := &memOrders{orders: map[uuid.UUID]*types.Order{}}
+	for i := range orders {
+		s.orders[orders[i].ID] = &orders[i]
+	}
+	return s
+}
+
+func (s *memOrders) GetOrderWithItemsByID(orderID uuid.UUID) (*types.OrderWithItems, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[orderID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &types.OrderWithItems{Order: *o}, nil
+}
+
+func (s *memOrders) SetPaymentProvider(orderID uuid.UUID, provider string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[orderID].PaymentProvider = provider
+	return nil
+}
+
+func (s *memOrders) TransitionOrderStatus(orderID uuid.UUID, status string, actorID uuid.NullUUID, note string) (*types.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[orderID]
+	o.Status = status
+	s.moves = append(s.moves, status)
+	cp := *o
+	return &cp, nil
+}
+
+// paid applies a successful payment the way Store does.
+func (s *memOrders) paid(orderID uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[orderID]
+	if o.Status != types.OrderStatusPending {
+		o.NeedsRefund = true
+		return
+	}
+	o.Status = types.OrderStatusPaid
+	s.moves = append(s.moves, o.Status)
+}
+
+func (s *memOrders) needsRefund(orderID uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.orders[orderID].NeedsRefund
+}
+
+func (s *memOrders) status(orderID uuid.UUID) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.orders[orderID].Status
+}
+
+func (s *memOrders) transitions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.moves)
+}
+
+// paymentTest is a payment handler over in-memory stores with one pending
+// order of KES 1000.50, to be paid with the one provider it is given.
+type paymentTest struct {
+	daraja  *fakeDaraja
+	gateway *fakeGateway
+	store   *memStore
+	orders  *memOrders
+	order   types.Order
+	user    uuid.UUID
+	h       *Handler
+	router  chi.Router
+}
+
+// newPaymentTest registers the handler's routes, so any configuration
+// they read must be set first.
+func newPaymentTest(provider PaymentProvider) *paymentTest {
+	tt := &paymentTest{store: newMemStore(), user: uuid.New()}
+	tt.order = types.Order{
+		ID:              uuid.New(),
+		UserID:          tt.user,
+		Total:           types.NewMoney(100050),
+		Status:          types.OrderStatusPending,
+		PaymentProvider: provider.Name(),
+	}
+	tt.orders = newMemOrders(tt.order)
+	tt.store.orders = tt.orders
+
+	tt.h = NewHandler(tt.store, tt.orders, nil, NewRegistry(provider), nil)
+	tt.router = chi.NewRouter()
+	tt.h.RegisterRoutes(tt.router)
+	return tt
+}
+
+// as serves a POST to a handler behind the JWT middleware, as the
+// order's owner.
+func (tt *paymentTest) as(pattern string, handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), types.UserKey, tt.user)))
+		})
+	})
+	r.Post(pattern, handler)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return rec
+}
+
+// serve sends req through the handler's public routes.
+func (tt *paymentTest) serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	tt.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (tt *paymentTest) payment(t *testing.T, id uuid.UUID) *types.Payment {
+	t.Helper()
+	pay, err := tt.store.GetPaymentByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pay
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,94 @@
+package mpesa
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/kimenyu/executive/types"
+)
+
+// Callback is the result of an STK push as posted by Daraja.
+type Callback struct {
+	MerchantRequestID string
+	CheckoutRequestID string
+	ResultCode        int
+	ResultDesc        string
+
+	// only present on success
+	Amount          types.Money
+	MpesaReceipt    string
+	Phone           string
+	TransactionDate string
+}
+
+func (cb *Callback) Success() bool {
+	return cb.ResultCode == 0
+}
+
+type callbackEnvelope struct {
+	Body struct {
+		STKCallback *struct {
+			MerchantRequestID string `json:"MerchantRequestID"`
+			CheckoutRequestID string `json:"CheckoutRequestID"`
+			ResultCode        int    `json:"ResultCode"`
+			ResultDesc        string `json:"ResultDesc"`
+			CallbackMetadata  struct {
+				Item []struct {
+					Name  string `json:"Name"`
+					Value any    `json:"Value"`
+				} `json:"Item"`
+			} `json:"CallbackMetadata"`
+		} `json:"stkCallback"`
+	} `json:"Body"`
+}
+
+// ParseCallback decodes an STK push callback body.
+func ParseCallback(body []byte) (*Callback, error) {
+	var env callbackEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("mpesa callback: %w", err)
+	}
+
+	stk := env.Body.STKCallback
+	if stk == nil || stk.CheckoutRequestID == "" {
+		return nil, fmt.Errorf("mpesa callback: missing stkCallback")
+	}
+
+	cb := &Callback{
+		MerchantRequestID: stk.MerchantRequestID,
+		CheckoutRequestID: stk.CheckoutRequestID,
+		ResultCode:        stk.ResultCode,
+		ResultDesc:        stk.ResultDesc,
+	}
+
+	for _, item := range stk.CallbackMetadata.Item {
+		switch item.Name {
+		case "Amount":
+			cb.Amount, _ = types.ParseMoney(stringValue(item.Value))
+		case "MpesaReceiptNumber":
+			cb.MpesaReceipt = stringValue(item.Value)
+		case "PhoneNumber":
+			cb.Phone = stringValue(item.Value)
+		case "TransactionDate":
+			cb.TransactionDate = stringValue(item.Value)
+		}
+	}
+
+	return cb, nil
+}
+
+// stringValue renders metadata values, which Daraja sends as numbers or
+// strings, without losing digits of long phone numbers or dates.
+func stringValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
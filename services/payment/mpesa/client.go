@@ -0,0 +1,183 @@
+// Package mpesa is a small client for the Safaricom Daraja API: OAuth,
+// Lipa Na M-Pesa Online (STK push) and its callbacks, and the reversal and
+// B2C requests used for refunds.
+package mpesa
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SandboxBaseURL    = "https://sandbox.safaricom.co.ke"
+	ProductionBaseURL = "https://api.safaricom.co.ke"
+)
+
+// Daraja timestamps are in East Africa Time
+var eat = time.FixedZone("EAT", 3*60*60)
+
+type Config struct {
+	BaseURL        string
+	ConsumerKey    string
+	ConsumerSecret string
+	ShortCode      string
+	Passkey        string
+	CallbackURL    string
+
+	// reversals and B2C payouts act as an API initiator; the security
+	// credential is the initiator password encrypted on the Daraja portal
+	InitiatorName      string
+	SecurityCredential string
+	B2CShortCode       string
+	ResultURL          string
+	TimeoutURL         string
+
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	cfg  Config
+	http *http.Client
+	now  func() time.Time
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewClient(cfg Config) *Client {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = SandboxBaseURL
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if cfg.B2CShortCode == "" {
+		cfg.B2CShortCode = cfg.ShortCode
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &Client{cfg: cfg, http: httpClient, now: time.Now}
+}
+
+// ErrRejected is wrapped by errors for requests Daraja answered but
+// refused to process.
+var ErrRejected = errors.New("rejected")
+
+// APIError is an error response from Daraja.
+type APIError struct {
+	StatusCode   int
+	RequestID    string `json:"requestId"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("daraja: %d %s: %s", e.StatusCode, e.ErrorCode, e.ErrorMessage)
+}
+
+// AccessToken returns a cached OAuth token, fetching a new one shortly
+// before the current one expires.
+func (c *Client) AccessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && c.now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.cfg.BaseURL+"/oauth/v1/generate?grant_type=client_credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(c.cfg.ConsumerKey, c.cfg.ConsumerSecret)
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := c.send(req, &out); err != nil {
+		return "", fmt.Errorf("mpesa oauth: %w", err)
+	}
+	if out.AccessToken == "" {
+		return "", fmt.Errorf("mpesa oauth: empty access token")
+	}
+
+	ttl := time.Hour
+	if d, err := time.ParseDuration(out.ExpiresIn + "s"); err == nil && d > 0 {
+		ttl = d
+	}
+	// refresh a minute early so a token never expires mid-request
+	if ttl > 2*time.Minute {
+		ttl -= time.Minute
+	}
+
+	c.token = out.AccessToken
+	c.tokenExpiry = c.now().Add(ttl)
+	return c.token, nil
+}
+
+// Password builds the Lipa Na M-Pesa password and the timestamp it was
+// derived from.
+func Password(shortCode, passkey string, t time.Time) (password, timestamp string) {
+	timestamp = t.In(eat).Format("20060102150405")
+	password = base64.StdEncoding.EncodeToString([]byte(shortCode + passkey + timestamp))
+	return password, timestamp
+}
+
+// postJSON sends body to path with a bearer token and decodes the response.
+func (c *Client) postJSON(ctx context.Context, path string, body, out any) error {
+	token, err := c.AccessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.BaseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.send(req, out)
+}
+
+func (c *Client) send(req *http.Request, out any) error {
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: res.StatusCode}
+		if json.Unmarshal(body, apiErr) != nil || apiErr.ErrorMessage == "" {
+			apiErr.ErrorMessage = strings.TrimSpace(string(body))
+		}
+		return apiErr
+	}
+
+	return json.Unmarshal(body, out)
+}
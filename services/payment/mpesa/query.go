@@ -0,0 +1,57 @@
+package mpesa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrStillProcessing is returned by STKQuery while the customer has not yet
+// answered the prompt.
+var ErrStillProcessing = errors.New("mpesa: transaction is still being processed")
+
+// Daraja reports an unfinished transaction as an error response
+const processingErrorCode = "500.001.1001"
+
+type STKQueryResponse struct {
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	ResultCode          string `json:"ResultCode"`
+	ResultDesc          string `json:"ResultDesc"`
+}
+
+// Success reports whether the customer completed the payment.
+func (r *STKQueryResponse) Success() bool {
+	code, err := strconv.Atoi(r.ResultCode)
+	return err == nil && code == 0
+}
+
+// STKQuery asks Daraja for the final result of an STK push. It is the
+// fallback for callbacks that never arrive; unlike the callback it carries
+// no receipt number or amount.
+func (c *Client) STKQuery(ctx context.Context, checkoutRequestID string) (*STKQueryResponse, error) {
+	password, timestamp := Password(c.cfg.ShortCode, c.cfg.Passkey, c.now())
+	payload := map[string]any{
+		"BusinessShortCode": c.cfg.ShortCode,
+		"Password":          password,
+		"Timestamp":         timestamp,
+		"CheckoutRequestID": checkoutRequestID,
+	}
+
+	var out STKQueryResponse
+	if err := c.postJSON(ctx, "/mpesa/stkpushquery/v1/query", payload, &out); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == processingErrorCode {
+			return nil, ErrStillProcessing
+		}
+		return nil, fmt.Errorf("mpesa stk query: %w", err)
+	}
+	if out.ResponseCode != "0" {
+		return nil, fmt.Errorf("mpesa stk query %w: %s %s", ErrRejected, out.ResponseCode, out.ResponseDescription)
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,116 @@
+package mpesa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// AsyncResponse acknowledges a request whose result is posted to the
+// configured ResultURL later, keyed by ConversationID.
+type AsyncResponse struct {
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ConversationID           string `json:"ConversationID"`
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+}
+
+// Reverse asks Daraja to reverse a whole transaction, identified by its
+// receipt number.
+func (c *Client) Reverse(ctx context.Context, receipt string, amount int, remarks string) (*AsyncResponse, error) {
+	payload := map[string]any{
+		"Initiator":              c.cfg.InitiatorName,
+		"SecurityCredential":     c.cfg.SecurityCredential,
+		"CommandID":              "TransactionReversal",
+		"TransactionID":          receipt,
+		"Amount":                 amount,
+		"ReceiverParty":          c.cfg.ShortCode,
+		"RecieverIdentifierType": "11", // sic, Daraja's spelling
+		"ResultURL":              c.cfg.ResultURL,
+		"QueueTimeOutURL":        c.cfg.TimeoutURL,
+		"Remarks":                truncate(remarks, 100),
+		"Occasion":               "Refund",
+	}
+
+	return c.async(ctx, "/mpesa/reversal/v1/request", "reversal", payload)
+}
+
+// B2C pays amount from the business to a customer's phone. Refunds use it
+// for partial amounts, which reversals cannot do.
+func (c *Client) B2C(ctx context.Context, phone string, amount int, remarks string) (*AsyncResponse, error) {
+	if amount < 1 {
+		return nil, fmt.Errorf("mpesa: amount must be at least 1")
+	}
+
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]any{
+		"InitiatorName":      c.cfg.InitiatorName,
+		"SecurityCredential": c.cfg.SecurityCredential,
+		"CommandID":          "BusinessPayment",
+		"Amount":             amount,
+		"PartyA":             c.cfg.B2CShortCode,
+		"PartyB":             phone,
+		"Remarks":            truncate(remarks, 100),
+		"QueueTimeOutURL":    c.cfg.TimeoutURL,
+		"ResultURL":          c.cfg.ResultURL,
+		"Occasion":           "Refund",
+	}
+
+	return c.async(ctx, "/mpesa/b2c/v1/paymentrequest", "b2c", payload)
+}
+
+func (c *Client) async(ctx context.Context, path, name string, payload any) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.postJSON(ctx, path, payload, &out); err != nil {
+		return nil, fmt.Errorf("mpesa %s: %w", name, err)
+	}
+	if out.ResponseCode != "0" {
+		return nil, fmt.Errorf("mpesa %s %w: %s %s", name, ErrRejected, out.ResponseCode, out.ResponseDescription)
+	}
+	return &out, nil
+}
+
+// Result is the outcome of a reversal or B2C request as posted to the
+// ResultURL.
+type Result struct {
+	ConversationID           string
+	OriginatorConversationID string
+	TransactionID            string
+	ResultCode               int
+	ResultDesc               string
+}
+
+func (r *Result) Success() bool {
+	return r.ResultCode == 0
+}
+
+// ParseResult decodes a reversal or B2C result body.
+func ParseResult(body []byte) (*Result, error) {
+	var env struct {
+		Result *struct {
+			ResultCode               int    `json:"ResultCode"`
+			ResultDesc               string `json:"ResultDesc"`
+			OriginatorConversationID string `json:"OriginatorConversationID"`
+			ConversationID           string `json:"ConversationID"`
+			TransactionID            string `json:"TransactionID"`
+		} `json:"Result"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("mpesa result: %w", err)
+	}
+	if env.Result == nil || env.Result.ConversationID == "" {
+		return nil, fmt.Errorf("mpesa result: missing Result")
+	}
+
+	return &Result{
+		ConversationID:           env.Result.ConversationID,
+		OriginatorConversationID: env.Result.OriginatorConversationID,
+		TransactionID:            env.Result.TransactionID,
+		ResultCode:               env.Result.ResultCode,
+		ResultDesc:               env.Result.ResultDesc,
+	}, nil
+}
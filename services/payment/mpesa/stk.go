@@ -0,0 +1,99 @@
+package mpesa
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kimenyu/executive/types"
+)
+
+type STKPushRequest struct {
+	Amount           int // whole shillings, Daraja rejects decimals
+	Phone            string
+	AccountReference string
+	Description      string
+}
+
+type STKPushResponse struct {
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	CustomerMessage     string `json:"CustomerMessage"`
+}
+
+// STKPush asks Daraja to prompt the customer's phone for payment. The
+// result arrives later on the configured callback URL, keyed by the
+// returned CheckoutRequestID.
+func (c *Client) STKPush(ctx context.Context, r STKPushRequest) (*STKPushResponse, error) {
+	if r.Amount < 1 {
+		return nil, fmt.Errorf("mpesa: amount must be at least 1")
+	}
+
+	phone, err := NormalizePhone(r.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	password, timestamp := Password(c.cfg.ShortCode, c.cfg.Passkey, c.now())
+	payload := map[string]any{
+		"BusinessShortCode": c.cfg.ShortCode,
+		"Password":          password,
+		"Timestamp":         timestamp,
+		"TransactionType":   "CustomerPayBillOnline",
+		"Amount":            r.Amount,
+		"PartyA":            phone,
+		"PartyB":            c.cfg.ShortCode,
+		"PhoneNumber":       phone,
+		"CallBackURL":       c.cfg.CallbackURL,
+		"AccountReference":  truncate(r.AccountReference, 12),
+		"TransactionDesc":   truncate(r.Description, 13),
+	}
+
+	var out STKPushResponse
+	if err := c.postJSON(ctx, "/mpesa/stkpush/v1/processrequest", payload, &out); err != nil {
+		return nil, fmt.Errorf("mpesa stk push: %w", err)
+	}
+	if out.ResponseCode != "0" {
+		return nil, fmt.Errorf("mpesa stk push %w: %s %s", ErrRejected, out.ResponseCode, out.ResponseDescription)
+	}
+
+	return &out, nil
+}
+
+// ChargeAmount converts an order total to the whole-shilling amount sent
+// to Daraja, rounding any cents up.
+func ChargeAmount(total types.Money) int {
+	return int(total.Units())
+}
+
+// NormalizePhone turns 07XXXXXXXX, 7XXXXXXXX and +2547XXXXXXXX style
+// numbers into the 2547XXXXXXXX form Daraja expects.
+func NormalizePhone(phone string) (string, error) {
+	p := strings.NewReplacer(" ", "", "-", "", "+", "").Replace(phone)
+
+	switch {
+	case strings.HasPrefix(p, "254") && len(p) == 12:
+	case strings.HasPrefix(p, "0") && len(p) == 10:
+		p = "254" + p[1:]
+	case len(p) == 9:
+		p = "254" + p
+	default:
+		return "", fmt.Errorf("mpesa: invalid phone number %q", phone)
+	}
+
+	for _, r := range p {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("mpesa: invalid phone number %q", phone)
+		}
+	}
+	return p, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
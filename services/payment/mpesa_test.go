@@ -0,0 +1,405 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/services/payment/mpesa"
+	"github.com/kimenyu/executive/types"
+)
+
+const testCallbackToken = "callback-secret"
+
+// fakeDaraja answers the Daraja endpoints the M-Pesa provider calls and
+// records what it was sent.
+type fakeDaraja struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	pushes    []map[string]any
+	queries   int
+	queryCode string // STK query ResultCode, empty while still processing
+	// asyncFault breaks reversal and B2C requests: "hang", "drop", a
+	// status code, or "rejected" for a refusal in a 200 response
+	asyncFault string
+	requests   map[string][]map[string]any
+}
+
+func newFakeDaraja(t *testing.T) *fakeDaraja {
+	d := &fakeDaraja{requests: map[string][]map[string]any{}}
+
+	r := chi.NewRouter()
+	r.Get("/oauth/v1/generate", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, http.StatusOK, map[string]string{"access_token": "token", "expires_in": "3599"})
+	})
+	r.Post("/mpesa/stkpush/v1/processrequest", func(w http.ResponseWriter, r *http.Request) {
+		in := d.record(r)
+		d.mu.Lock()
+		d.pushes = append(d.pushes, in)
+		n := len(d.pushes)
+		d.mu.Unlock()
+
+		writeTestJSON(w, http.StatusOK, map[string]string{
+			"MerchantRequestID": "merchant-" + strconv.Itoa(n),
+			"CheckoutRequestID": "ws_CO_" + strconv.Itoa(n),
+			"ResponseCode":      "0",
+			"CustomerMessage":   "Success. Request accepted for processing",
+		})
+	})
+	for _, path := range []string{"/mpesa/reversal/v1/request", "/mpesa/b2c/v1/paymentrequest"} {
+		r.Post(path, func(w http.ResponseWriter, r *http.Request) {
+			d.record(r)
+			d.mu.Lock()
+			n := len(d.requests[r.URL.Path])
+			fault := d.asyncFault
+			d.mu.Unlock()
+
+			switch fault {
+			case "":
+			case "hang":
+				<-r.Context().Done()
+				return
+			case "drop":
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			case "rejected":
+				writeTestJSON(w, http.StatusOK, map[string]string{"ResponseCode": "1", "ResponseDescription": "Rejected"})
+				return
+			default:
+				status, _ := strconv.Atoi(fault)
+				writeTestJSON(w, status, map[string]string{"errorCode": fault + ".001", "errorMessage": "error " + fault})
+				return
+			}
+
+			writeTestJSON(w, http.StatusOK, map[string]string{
+				"ConversationID":           "AG_" + strconv.Itoa(n),
+				"OriginatorConversationID": "orig-" + strconv.Itoa(n),
+				"ResponseCode":             "0",
+				"ResponseDescription":      "Accept the service request successfully.",
+			})
+		})
+	}
+	r.Post("/mpesa/stkpushquery/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		in := d.record(r)
+		d.mu.Lock()
+		d.queries++
+		code := d.queryCode
+		d.mu.Unlock()
+
+		if code == "" {
+			writeTestJSON(w, http.StatusInternalServerError, map[string]string{
+				"errorCode": "500.001.1001", "errorMessage": "The transaction is being processed",
+			})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, map[string]any{
+			"ResponseCode":      "0",
+			"CheckoutRequestID": in["CheckoutRequestID"],
+			"ResultCode":        code,
+			"ResultDesc":        "result " + code,
+		})
+	})
+
+	d.Server = httptest.NewServer(r)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *fakeDaraja) record(r *http.Request) map[string]any {
+	var in map[string]any
+	json.NewDecoder(r.Body).Decode(&in)
+	d.mu.Lock()
+	d.requests[r.URL.Path] = append(d.requests[r.URL.Path], in)
+	d.mu.Unlock()
+	return in
+}
+
+func (d *fakeDaraja) setQueryCode(code string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queryCode = code
+}
+
+func (d *fakeDaraja) setAsyncFault(fault string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.asyncFault = fault
+}
+
+func (d *fakeDaraja) queryCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queries
+}
+
+func newMpesaTest(t *testing.T, token string) *paymentTest {
+	previous := configs.Envs.MpesaCallbackToken
+	configs.Envs.MpesaCallbackToken = token
+	t.Cleanup(func() { configs.Envs.MpesaCallbackToken = previous })
+
+	daraja := newFakeDaraja(t)
+	client := mpesa.NewClient(mpesa.Config{
+		BaseURL:     daraja.URL,
+		ShortCode:   "174379",
+		Passkey:     "passkey",
+		CallbackURL: WithToken("https://shop.example/api/v1/payments/mpesa/callback", token),
+
+		InitiatorName:      "testapi",
+		SecurityCredential: "credential",
+		ResultURL:          WithToken("https://shop.example/api/v1/payments/mpesa/refund/result", token),
+		TimeoutURL:         WithToken("https://shop.example/api/v1/payments/mpesa/refund/timeout", token),
+
+		HTTPClient: &http.Client{Timeout: time.Second},
+	})
+
+	tt := newPaymentTest(NewMpesaProvider(client))
+	tt.daraja = daraja
+	return tt
+}
+
+// pay starts an M-Pesa payment for the order as its owner.
+func (tt *paymentTest) pay(t *testing.T) *types.Payment {
+	t.Helper()
+
+	rec := tt.as("/orders/{orderID}/pay", tt.h.handlePay, "/orders/"+tt.order.ID.String()+"/pay", `{"phone":"0712 345 678"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("pay: status %d: %s", rec.Code, rec.Body)
+	}
+
+	pay, err := tt.store.GetPendingPayment(tt.order.ID, types.PaymentProviderMpesa)
+	if err != nil {
+		t.Fatalf("pay: no pending payment: %v", err)
+	}
+	return pay
+}
+
+// post sends a Daraja callback to path with token in its query.
+func (tt *paymentTest) post(path, token string, body []byte) *httptest.ResponseRecorder {
+	if token != "" {
+		path += "?" + TokenParam + "=" + url.QueryEscape(token)
+	}
+	return tt.serve(httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+}
+
+// stkCallback builds a Daraja STK callback; amount is left out when nil.
+func stkCallback(checkoutID string, code int, amount any) []byte {
+	cb := map[string]any{
+		"MerchantRequestID": "merchant",
+		"CheckoutRequestID": checkoutID,
+		"ResultCode":        code,
+		"ResultDesc":        "result",
+	}
+	if code == 0 {
+		items := []map[string]any{
+			{"Name": "MpesaReceiptNumber", "Value": "RCPT" + checkoutID},
+			{"Name": "PhoneNumber", "Value": 254712345678},
+			{"Name": "TransactionDate", "Value": time.Now().Format("20060102150405")},
+		}
+		if amount != nil {
+			items = append(items, map[string]any{"Name": "Amount", "Value": amount})
+		}
+		cb["CallbackMetadata"] = map[string]any{"Item": items}
+	}
+	b, _ := json.Marshal(map[string]any{"Body": map[string]any{"stkCallback": cb}})
+	return b
+}
+
+func TestMpesaPush(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	pay := tt.pay(t)
+
+	if pay.CheckoutRequestID != "ws_CO_1" || pay.Status != types.PaymentStatusPending {
+		t.Fatalf("payment = %+v, want pending with the checkout request ID", pay)
+	}
+	if len(tt.daraja.pushes) != 1 {
+		t.Fatalf("%d STK pushes, want 1", len(tt.daraja.pushes))
+	}
+
+	push := tt.daraja.pushes[0]
+	if push["Amount"] != float64(1001) {
+		t.Errorf("pushed amount %v, want 1001 (rounded up)", push["Amount"])
+	}
+	if push["PhoneNumber"] != "254712345678" || push["PartyA"] != "254712345678" {
+		t.Errorf("pushed phone %v, want 254712345678", push["PhoneNumber"])
+	}
+	callback, err := url.Parse(push["CallBackURL"].(string))
+	if err != nil || callback.Query().Get(TokenParam) != testCallbackToken {
+		t.Errorf("callback URL %v does not carry the callback token", push["CallBackURL"])
+	}
+}
+
+func TestMpesaCallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      int
+		amount    any
+		queryCode string
+		wantPay   string
+		wantOrder string
+	}{
+		{"success", 0, 1001, "0", types.PaymentStatusSuccess, types.OrderStatusPaid},
+		{"cancelled", 1032, nil, "1032", types.PaymentStatusFailed, types.OrderStatusPending},
+		{"timeout", 1037, nil, "1037", types.PaymentStatusFailed, types.OrderStatusPending},
+		{"success without amount", 0, nil, "0", types.PaymentStatusPending, types.OrderStatusPending},
+		{"underpaid", 0, 1000, "0", types.PaymentStatusPending, types.OrderStatusPending},
+		{"overpaid", 0, 2000, "0", types.PaymentStatusPending, types.OrderStatusPending},
+		{"success still processing", 0, 1001, "", types.PaymentStatusPending, types.OrderStatusPending},
+		{"success the provider denies", 0, 1001, "1032", types.PaymentStatusPending, types.OrderStatusPending},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newMpesaTest(t, testCallbackToken)
+			pay := tt.pay(t)
+			tt.daraja.setQueryCode(tc.queryCode)
+
+			rec := tt.post("/payments/mpesa/callback", testCallbackToken, stkCallback(pay.CheckoutRequestID, tc.code, tc.amount))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("callback: status %d: %s", rec.Code, rec.Body)
+			}
+
+			if got := tt.payment(t, pay.ID); got.Status != tc.wantPay {
+				t.Errorf("payment %s, want %s", got.Status, tc.wantPay)
+			}
+			if got := tt.orders.status(tt.order.ID); got != tc.wantOrder {
+				t.Errorf("order %s, want %s", got, tc.wantOrder)
+			}
+			if tt.daraja.queryCount() != 1 {
+				t.Errorf("%d STK queries, want the callback confirmed once", tt.daraja.queryCount())
+			}
+		})
+	}
+}
+
+func TestMpesaPushWhilePending(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	tt.pay(t)
+
+	rec := tt.as("/orders/{orderID}/pay", tt.h.handlePay, "/orders/"+tt.order.ID.String()+"/pay", `{"phone":"0712 345 678"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("second push: status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if len(tt.daraja.pushes) != 1 {
+		t.Errorf("%d STK pushes, want 1", len(tt.daraja.pushes))
+	}
+}
+
+func TestMpesaCallbackAfterCancel(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	pay := tt.pay(t)
+	tt.daraja.setQueryCode("0")
+
+	// the customer cancels while the push is still on their phone
+	tt.orders.TransitionOrderStatus(tt.order.ID, types.OrderStatusCancelled, uuid.NullUUID{}, "")
+
+	rec := tt.post("/payments/mpesa/callback", testCallbackToken, stkCallback(pay.CheckoutRequestID, 0, 1001))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if got := tt.payment(t, pay.ID); got.Status != types.PaymentStatusSuccess {
+		t.Errorf("payment %s, want the captured money recorded", got.Status)
+	}
+	if got := tt.orders.status(tt.order.ID); got != types.OrderStatusCancelled {
+		t.Errorf("order %s, want it left cancelled", got)
+	}
+	if !tt.orders.needsRefund(tt.order.ID) {
+		t.Errorf("order paid after cancelling is not flagged for a refund")
+	}
+}
+
+func TestMpesaCallbackReceipt(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	pay := tt.pay(t)
+	tt.daraja.setQueryCode("0")
+
+	tt.post("/payments/mpesa/callback", testCallbackToken, stkCallback(pay.CheckoutRequestID, 0, 1001))
+
+	if got := tt.payment(t, pay.ID); got.MpesaReceipt != "RCPT"+pay.CheckoutRequestID {
+		t.Errorf("receipt %q not recorded", got.MpesaReceipt)
+	}
+}
+
+func TestMpesaCallbackToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		sent       string
+		want       int
+	}{
+		{"missing", testCallbackToken, "", http.StatusUnauthorized},
+		{"wrong", testCallbackToken, "guess", http.StatusUnauthorized},
+		{"prefix", testCallbackToken, testCallbackToken[:4], http.StatusUnauthorized},
+		{"not configured", "", "", http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newMpesaTest(t, tc.configured)
+			pay := tt.pay(t)
+			tt.daraja.setQueryCode("0")
+
+			rec := tt.post("/payments/mpesa/callback", tc.sent, stkCallback(pay.CheckoutRequestID, 0, 1001))
+			if rec.Code != tc.want {
+				t.Fatalf("status %d, want %d", rec.Code, tc.want)
+			}
+			if got := tt.payment(t, pay.ID); got.Status != types.PaymentStatusPending {
+				t.Errorf("payment %s after a rejected callback", got.Status)
+			}
+			if tt.daraja.queryCount() != 0 {
+				t.Errorf("rejected callback queried Daraja")
+			}
+		})
+	}
+}
+
+func TestMpesaDuplicateCallback(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	pay := tt.pay(t)
+	tt.daraja.setQueryCode("0")
+
+	body := stkCallback(pay.CheckoutRequestID, 0, 1001)
+	for i := 0; i < 3; i++ {
+		if rec := tt.post("/payments/mpesa/callback", testCallbackToken, body); rec.Code != http.StatusOK {
+			t.Fatalf("callback %d: status %d: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+
+	// a late failure must not undo the payment either
+	tt.post("/payments/mpesa/callback", testCallbackToken, stkCallback(pay.CheckoutRequestID, 1032, nil))
+
+	if got := tt.payment(t, pay.ID); got.Status != types.PaymentStatusSuccess {
+		t.Errorf("payment %s, want success", got.Status)
+	}
+	if got := tt.orders.transitions(); !slices.Equal(got, []string{types.OrderStatusPaid}) {
+		t.Errorf("order transitions %v, want a single move to paid", got)
+	}
+	if tt.daraja.queryCount() != 1 {
+		t.Errorf("%d STK queries, want 1", tt.daraja.queryCount())
+	}
+}
+
+func TestMpesaCallbackUnknownReference(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	tt.daraja.setQueryCode("0")
+
+	rec := tt.post("/payments/mpesa/callback", testCallbackToken, stkCallback("ws_CO_forged", 0, 1001))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want the callback acknowledged", rec.Code)
+	}
+	if tt.daraja.queryCount() != 0 || len(tt.orders.transitions()) != 0 {
+		t.Errorf("unknown reference was acted on")
+	}
+}
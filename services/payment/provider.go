@@ -0,0 +1,97 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/kimenyu/executive/types"
+)
+
+var (
+	ErrUnknownProvider     = errors.New("unknown payment provider")
+	ErrInvalidPayment      = errors.New("invalid payment request")
+	ErrCallbackUnsupported = errors.New("provider does not send callbacks")
+)
+
+// PaymentProvider collects money for orders through one payment method.
+type PaymentProvider interface {
+	Name() string
+
+	// Initiate starts collecting pay.Amount for pay.OrderID. Providers that
+	// settle later return a pending result carrying the reference their
+	// callbacks and Query use. Bad input is reported as ErrInvalidPayment.
+	Initiate(ctx context.Context, pay *types.Payment, req PaymentRequest) (*PaymentResult, error)
+
+	// ParseCallback decodes a webhook from the provider. Authenticating the
+	// request is left to middleware such as VerifySignature.
+	ParseCallback(body []byte) (*PaymentResult, error)
+
+	// Query asks the provider for the current result of pay.
+	Query(ctx context.Context, pay *types.Payment) (*PaymentResult, error)
+
+	// Refund returns amount of a successful payment to the customer.
+	// Asynchronous refunds come back pending with the reference their
+	// result callback carries.
+	Refund(ctx context.Context, pay *types.Payment, amount types.Money, reason string) (*RefundResult, error)
+
+	// ParseRefundCallback decodes the result of an asynchronous refund.
+	ParseRefundCallback(body []byte) (*RefundResult, error)
+}
+
+type PaymentRequest struct {
+	Phone string
+}
+
+// PaymentResult is what a provider knows about a payment.
+type PaymentResult struct {
+	Status            string // see types.PaymentStatus* constants
+	Reference         string // stored as checkout_request_id
+	MerchantReference string
+	Receipt           string
+	Amount            types.Money // amount actually paid, zero when unknown
+	Phone             string
+	RedirectURL       string // where the customer completes the payment, if anywhere
+	Message           string
+	Raw               json.RawMessage
+}
+
+type RefundResult struct {
+	Status    string // see types.PaymentStatus* constants
+	Reference string
+	Amount    types.Money // amount actually sent, zero when it is the amount asked for
+	Raw       json.RawMessage
+}
+
+// Registry holds the payment providers the API accepts, by name.
+type Registry struct {
+	providers map[string]PaymentProvider
+}
+
+func NewRegistry(providers ...PaymentProvider) *Registry {
+	r := &Registry{providers: make(map[string]PaymentProvider, len(providers))}
+	for _, p := range providers {
+		r.providers[p.Name()] = p
+	}
+	return r
+}
+
+func (r *Registry) Get(name string) (PaymentProvider, error) {
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+	}
+	return p, nil
+}
+
+// Names returns the registered provider names in sorted order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,97 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kimenyu/executive/services/payment/card"
+	"github.com/kimenyu/executive/types"
+)
+
+// CardProvider takes card payments on a hosted gateway checkout page.
+type CardProvider struct {
+	client *card.Client
+}
+
+func NewCardProvider(client *card.Client) *CardProvider {
+	return &CardProvider{client: client}
+}
+
+func (p *CardProvider) Name() string { return types.PaymentProviderCard }
+
+func (p *CardProvider) Initiate(ctx context.Context, pay *types.Payment, req PaymentRequest) (*PaymentResult, error) {
+	charge, err := p.client.CreateCharge(ctx, pay.Amount.Amount, pay.ID.String(), "Order "+pay.OrderID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	res := chargeResult(charge)
+	res.RedirectURL = charge.CheckoutURL
+	return res, nil
+}
+
+func (p *CardProvider) ParseCallback(body []byte) (*PaymentResult, error) {
+	ev, err := card.ParseEvent(body)
+	if err != nil {
+		return nil, err
+	}
+
+	res := chargeResult(&ev.Data)
+	res.Raw = body
+	return res, nil
+}
+
+func (p *CardProvider) Query(ctx context.Context, pay *types.Payment) (*PaymentResult, error) {
+	charge, err := p.client.GetCharge(ctx, pay.CheckoutRequestID)
+	if err != nil {
+		return nil, err
+	}
+	return chargeResult(charge), nil
+}
+
+func (p *CardProvider) Refund(ctx context.Context, pay *types.Payment, amount types.Money, reason string) (*RefundResult, error) {
+	refund, err := p.client.CreateRefund(ctx, pay.CheckoutRequestID, amount.Amount, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _ := json.Marshal(refund)
+	return &RefundResult{
+		Status:    paymentStatus(refund.Status),
+		Reference: refund.ID,
+		Raw:       raw,
+	}, nil
+}
+
+// ParseRefundCallback is not needed: the gateway settles refunds at once.
+func (p *CardProvider) ParseRefundCallback(body []byte) (*RefundResult, error) {
+	return nil, ErrCallbackUnsupported
+}
+
+func chargeResult(charge *card.Charge) *PaymentResult {
+	raw, _ := json.Marshal(charge)
+	res := &PaymentResult{
+		Status:    paymentStatus(charge.Status),
+		Reference: charge.ID,
+		Message:   fmt.Sprintf("charge %s", charge.Status),
+		Raw:       raw,
+	}
+	if res.Status == types.PaymentStatusSuccess {
+		res.Amount = types.Money{Amount: charge.Amount, Currency: charge.Currency}
+		res.Receipt = charge.ID
+	}
+	return res
+}
+
+// paymentStatus maps gateway statuses onto payment statuses.
+func paymentStatus(status string) string {
+	switch status {
+	case card.StatusSucceeded:
+		return types.PaymentStatusSuccess
+	case card.StatusFailed:
+		return types.PaymentStatusFailed
+	default:
+		return types.PaymentStatusPending
+	}
+}
@@ -0,0 +1,43 @@
+package payment
+
+import (
+	"context"
+
+	"github.com/kimenyu/executive/types"
+)
+
+// CashOnDeliveryProvider takes payment in cash when the order is handed
+// over. Nothing happens online: the order store records the payment when
+// the order is marked delivered.
+type CashOnDeliveryProvider struct{}
+
+func NewCashOnDeliveryProvider() *CashOnDeliveryProvider {
+	return &CashOnDeliveryProvider{}
+}
+
+func (p *CashOnDeliveryProvider) Name() string { return types.PaymentProviderCOD }
+
+func (p *CashOnDeliveryProvider) Initiate(ctx context.Context, pay *types.Payment, req PaymentRequest) (*PaymentResult, error) {
+	return &PaymentResult{
+		Status:  types.PaymentStatusPending,
+		Message: "Pay in cash when your order is delivered",
+	}, nil
+}
+
+func (p *CashOnDeliveryProvider) ParseCallback(body []byte) (*PaymentResult, error) {
+	return nil, ErrCallbackUnsupported
+}
+
+// Query reports the stored status; only delivery settles cash payments.
+func (p *CashOnDeliveryProvider) Query(ctx context.Context, pay *types.Payment) (*PaymentResult, error) {
+	return &PaymentResult{Status: pay.Status, Reference: pay.CheckoutRequestID}, nil
+}
+
+// Refund records a cash refund, which is paid out by hand.
+func (p *CashOnDeliveryProvider) Refund(ctx context.Context, pay *types.Payment, amount types.Money, reason string) (*RefundResult, error) {
+	return &RefundResult{Status: types.PaymentStatusSuccess}, nil
+}
+
+func (p *CashOnDeliveryProvider) ParseRefundCallback(body []byte) (*RefundResult, error) {
+	return nil, ErrCallbackUnsupported
+}
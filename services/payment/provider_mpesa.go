@@ -0,0 +1,151 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kimenyu/executive/services/payment/mpesa"
+	"github.com/kimenyu/executive/types"
+)
+
+// MpesaProvider collects payments with Lipa Na M-Pesa Online (STK push).
+type MpesaProvider struct {
+	client *mpesa.Client
+}
+
+func NewMpesaProvider(client *mpesa.Client) *MpesaProvider {
+	return &MpesaProvider{client: client}
+}
+
+func (p *MpesaProvider) Name() string { return types.PaymentProviderMpesa }
+
+func (p *MpesaProvider) Initiate(ctx context.Context, pay *types.Payment, req PaymentRequest) (*PaymentResult, error) {
+	phone, err := mpesa.NormalizePhone(req.Phone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayment, err)
+	}
+
+	res, err := p.client.STKPush(ctx, mpesa.STKPushRequest{
+		Amount:           mpesa.ChargeAmount(pay.Amount),
+		Phone:            phone,
+		AccountReference: strings.ToUpper(pay.OrderID.String()[:8]),
+		Description:      "Order payment",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaymentResult{
+		Status:            types.PaymentStatusPending,
+		Reference:         res.CheckoutRequestID,
+		MerchantReference: res.MerchantRequestID,
+		Phone:             phone,
+		Message:           res.CustomerMessage,
+	}, nil
+}
+
+func (p *MpesaProvider) ParseCallback(body []byte) (*PaymentResult, error) {
+	cb, err := mpesa.ParseCallback(body)
+	if err != nil {
+		return nil, err
+	}
+
+	status := types.PaymentStatusFailed
+	if cb.Success() {
+		status = types.PaymentStatusSuccess
+	}
+
+	return &PaymentResult{
+		Status:            status,
+		Reference:         cb.CheckoutRequestID,
+		MerchantReference: cb.MerchantRequestID,
+		Receipt:           cb.MpesaReceipt,
+		Amount:            cb.Amount,
+		Phone:             cb.Phone,
+		Message:           cb.ResultDesc,
+		Raw:               body,
+	}, nil
+}
+
+// Query uses the STK Query API, which reports the outcome but not the
+// receipt number or the amount paid.
+func (p *MpesaProvider) Query(ctx context.Context, pay *types.Payment) (*PaymentResult, error) {
+	res, err := p.client.STKQuery(ctx, pay.CheckoutRequestID)
+	if errors.Is(err, mpesa.ErrStillProcessing) {
+		return &PaymentResult{Status: types.PaymentStatusPending, Reference: pay.CheckoutRequestID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := types.PaymentStatusFailed
+	if res.Success() {
+		status = types.PaymentStatusSuccess
+	}
+	raw, _ := json.Marshal(res)
+
+	return &PaymentResult{
+		Status:            status,
+		Reference:         res.CheckoutRequestID,
+		MerchantReference: res.MerchantRequestID,
+		Message:           res.ResultDesc,
+		Raw:               raw,
+	}, nil
+}
+
+// Refund reverses the whole transaction when it can, which returns what
+// was charged: the total rounded up to whole shillings. Partial refunds,
+// and payments settled without a receipt number, are paid back with B2C,
+// which only takes whole shillings.
+func (p *MpesaProvider) Refund(ctx context.Context, pay *types.Payment, amount types.Money, reason string) (*RefundResult, error) {
+	var (
+		res  *mpesa.AsyncResponse
+		sent types.Money
+		err  error
+	)
+
+	if pay.MpesaReceipt != "" && amount.Amount >= pay.Amount.Amount {
+		sent = chargedAmount(pay)
+		res, err = p.client.Reverse(ctx, pay.MpesaReceipt, mpesa.ChargeAmount(pay.Amount), reason)
+	} else {
+		if amount.Amount%100 != 0 {
+			return nil, fmt.Errorf("%w: partial M-Pesa refunds must be whole shillings", ErrInvalidPayment)
+		}
+		if pay.Phone == "" {
+			return nil, fmt.Errorf("%w: payment has no phone number to refund to", ErrInvalidPayment)
+		}
+		res, err = p.client.B2C(ctx, pay.Phone, int(amount.Units()), reason)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _ := json.Marshal(res)
+	return &RefundResult{
+		Status:    types.PaymentStatusPending,
+		Reference: res.ConversationID,
+		Amount:    sent,
+		Raw:       raw,
+	}, nil
+}
+
+func (p *MpesaProvider) ParseRefundCallback(body []byte) (*RefundResult, error) {
+	result, err := mpesa.ParseResult(body)
+	if err != nil {
+		return nil, err
+	}
+
+	status := types.PaymentStatusFailed
+	if result.Success() {
+		status = types.PaymentStatusSuccess
+	}
+
+	return &RefundResult{
+		Status:    status,
+		Reference: result.ConversationID,
+		Raw:       body,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kimenyu/executive/types"
+)
+
+// payments resolved per pass, so one slow pass cannot run forever
+const reconcileBatchSize = 100
+
+// ReconcileReport summarises one reconciliation pass.
+type ReconcileReport struct {
+	Checked int `json:"checked"`
+	Paid    int `json:"paid"`
+	Failed  int `json:"failed"`
+	Pending int `json:"pending"`
+	Review  int `json:"review"` // flagged because the provider cannot be asked
+	Errors  int `json:"errors"`
+}
+
+// Reconciler resolves payments whose callback never arrived by asking the
+// provider for the result, then settles the payment and its order the same
+// way the callback would have.
+type Reconciler struct {
+	store      types.PaymentStore
+	orderStore types.OrderStore
+	providers  *Registry
+	after      time.Duration
+
+	// passes never overlap, whether started by the ticker or an admin
+	mu sync.Mutex
+}
+
+func NewReconciler(store types.PaymentStore, orderStore types.OrderStore, providers *Registry, after time.Duration) *Reconciler {
+	return &Reconciler{store: store, orderStore: orderStore, providers: providers, after: after}
+}
+
+// Run reconciles every interval until ctx is cancelled.
+func (rc *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := rc.ReconcileOnce(ctx); err != nil {
+				log.Printf("payment reconciliation failed: %v", err)
+			}
+		}
+	}
+}
+
+// ReconcileOnce checks every payment that has been pending for longer than
+// the configured age.
+func (rc *Reconciler) ReconcileOnce(ctx context.Context) (*ReconcileReport, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// cash is only settled on delivery, so there is nothing to ask about
+	providers := slices.DeleteFunc(rc.providers.Names(), func(name string) bool {
+		return name == types.PaymentProviderCOD
+	})
+
+	payments, err := rc.store.ListStalePendingPayments(time.Now().Add(-rc.after), providers, reconcileBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{}
+	for i := range payments {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		pay := &payments[i]
+		report.Checked++
+
+		status, err := rc.resolve(ctx, pay)
+		if err != nil {
+			log.Printf("reconciling payment %s: %v", pay.ID, err)
+			report.Errors++
+			continue
+		}
+
+		switch status {
+		case types.PaymentStatusSuccess:
+			report.Paid++
+		case types.PaymentStatusFailed:
+			report.Failed++
+		case statusReview:
+			report.Review++
+		default:
+			report.Pending++
+		}
+	}
+
+	if report.Checked > 0 {
+		log.Printf("payment reconciliation: checked %d, paid %d, failed %d, still pending %d, flagged for review %d, errors %d",
+			report.Checked, report.Paid, report.Failed, report.Pending, report.Review, report.Errors)
+	}
+	return report, nil
+}
+
+// statusReview is what resolve reports for payments it flagged for review.
+const statusReview = "review"
+
+// resolve settles a single payment and returns its resulting status.
+func (rc *Reconciler) resolve(ctx context.Context, pay *types.Payment) (string, error) {
+	provider, err := rc.providers.Get(pay.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	// without a reference there is nothing to ask the provider about, but
+	// the request may still have reached it if we crashed before storing
+	// the answer, so failing the payment could lose a real charge
+	if pay.CheckoutRequestID == "" {
+		if err := rc.store.FlagPaymentForReview(pay.ID); err != nil {
+			return "", err
+		}
+		log.Printf("%s payment %s for order %s has no provider reference, flagged for review", pay.Provider, pay.ID, pay.OrderID)
+		return statusReview, nil
+	}
+
+	res, err := provider.Query(ctx, pay)
+	if err != nil {
+		return "", err
+	}
+
+	if res.Status == types.PaymentStatusPending {
+		return res.Status, nil
+	}
+
+	if err := settle(rc.store, pay, res); err == sql.ErrNoRows {
+		// the callback got there first
+		return res.Status, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	log.Printf("reconciled %s payment %s for order %s: %s", pay.Provider, pay.ID, pay.OrderID, pay.Status)
+	return pay.Status, nil
+}
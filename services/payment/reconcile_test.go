@@ -0,0 +1,55 @@
+package payment
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/types"
+)
+
+func TestReconcileWithoutReference(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+
+	// the push went out but we crashed before storing its reference
+	lost := &types.Payment{
+		ID:        uuid.New(),
+		OrderID:   tt.order.ID,
+		Amount:    tt.order.Total,
+		Provider:  types.PaymentProviderMpesa,
+		Status:    types.PaymentStatusPending,
+		CreatedAt: time.Now().Add(-time.Hour),
+	}
+	if err := tt.store.CreatePayment(lost); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := NewReconciler(tt.store, tt.orders, tt.h.providers, time.Minute)
+	report, err := rc.ReconcileOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || report.Review != 1 || report.Failed != 0 {
+		t.Errorf("report %+v, want one payment flagged for review", report)
+	}
+
+	got := tt.payment(t, lost.ID)
+	if got.Status != types.PaymentStatusPending || !got.NeedsReview {
+		t.Errorf("payment %s, needs_review %v; want it left pending and flagged", got.Status, got.NeedsReview)
+	}
+	if tt.daraja.queryCount() != 0 {
+		t.Errorf("queried Daraja without a reference")
+	}
+
+	if report, _ := rc.ReconcileOnce(context.Background()); report.Checked != 0 {
+		t.Errorf("flagged payment checked again: %+v", report)
+	}
+
+	// the flagged attempt does not keep the customer from paying
+	rec := tt.as("/orders/{orderID}/pay", tt.h.handlePay, "/orders/"+tt.order.ID.String()+"/pay", `{"phone":"0712 345 678"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("pay: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,354 @@
+package payment
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/services/payment/card"
+	"github.com/kimenyu/executive/services/payment/mpesa"
+	"github.com/kimenyu/executive/types"
+	"github.com/kimenyu/executive/utils"
+)
+
+// refundableStatuses are the order statuses money can be returned from.
+// Cancelled orders qualify while some of their captured money has not been
+// refunded, whether or not they carry the needs_refund flag.
+var refundableStatuses = map[string]bool{
+	types.OrderStatusPaid:              true,
+	types.OrderStatusDelivered:         true,
+	types.OrderStatusCompleted:         true,
+	types.OrderStatusPartiallyRefunded: true,
+}
+
+// handleCreateRefund refunds all or part of an order's payment through the
+// provider that collected it.
+func (h *Handler) handleCreateRefund(w http.ResponseWriter, r *http.Request) {
+	orderID, err := uuid.Parse(chi.URLParam(r, "orderID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	var input types.CreateRefundPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	order, err := h.orderStore.GetOrderWithItemsByID(orderID)
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	refundable := refundableStatuses[order.Order.Status]
+	if order.Order.Status == types.OrderStatusCancelled {
+		captured, refunded, err := h.store.RefundTotals(orderID)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		refundable = captured.Amount > refunded.Amount
+	}
+	if !refundable {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("order is %s and cannot be refunded", order.Order.Status))
+		return
+	}
+
+	var pay *types.Payment
+	if input.PaymentID != uuid.Nil {
+		pay, err = h.store.GetPaymentByID(input.PaymentID)
+		if err == nil && pay.OrderID != orderID {
+			err = sql.ErrNoRows
+		}
+	} else {
+		pay, err = h.store.GetCapturedPayment(orderID)
+	}
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("order has no captured payment"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	provider, err := h.providers.Get(pay.Provider)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	refund := &types.Refund{
+		ID:        uuid.New(),
+		PaymentID: pay.ID,
+		OrderID:   orderID,
+		Amount:    input.Amount,
+		Reason:    input.Reason,
+		ActorID:   uuid.NullUUID{UUID: types.UserIDFromContext(r.Context()), Valid: true},
+		CreatedAt: time.Now(),
+	}
+
+	// reserves the amount, so the cap holds while the provider works
+	if err := h.store.CreateRefund(refund); err != nil {
+		if errors.Is(err, ErrRefundExceedsPayment) || errors.Is(err, ErrPaymentNotCaptured) {
+			utils.WriteError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, err := provider.Refund(r.Context(), pay, refund.Amount, refund.Reason)
+	if err != nil && !refundDeclined(err) {
+		// the provider may have acted on a request whose answer was lost,
+		// so the amount stays reserved until someone checks
+		log.Printf("refund %s left pending, outcome unknown: %v", refund.ID, err)
+		utils.WriteError(w, http.StatusBadGateway, fmt.Errorf("refund %s is pending, the provider's answer was lost: %w", refund.ID, err))
+		return
+	}
+	if err != nil {
+		if _, cerr := h.store.CompleteRefund(refund.ID, types.PaymentStatusFailed, nil); cerr != nil {
+			log.Printf("marking refund %s failed: %v", refund.ID, cerr)
+		}
+
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrInvalidPayment) {
+			status = http.StatusBadRequest
+		}
+		utils.WriteError(w, status, err)
+		return
+	}
+
+	refund.ProviderReference = res.Reference
+	if !res.Amount.IsZero() {
+		refund.Amount = res.Amount
+	}
+	if res.Reference != "" || !res.Amount.IsZero() {
+		if err := h.store.SetRefundReference(refund.ID, res.Reference, refund.Amount); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if res.Status == types.PaymentStatusPending {
+		utils.WriteJSON(w, http.StatusAccepted, refund)
+		return
+	}
+
+	completed, err := h.finishRefund(refund.ID, res)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, completed)
+}
+
+// refundDeclined reports whether a Refund error means the refund was
+// certainly not made: it was invalid, or the provider answered and refused
+// it. Timeouts, dropped connections and server errors leave that open.
+func refundDeclined(err error) bool {
+	if errors.Is(err, ErrInvalidPayment) || errors.Is(err, mpesa.ErrRejected) {
+		return true
+	}
+
+	var mpesaErr *mpesa.APIError
+	if errors.As(err, &mpesaErr) {
+		return mpesaErr.StatusCode >= 400 && mpesaErr.StatusCode < 500
+	}
+	var cardErr *card.APIError
+	if errors.As(err, &cardErr) {
+		return cardErr.StatusCode >= 400 && cardErr.StatusCode < 500
+	}
+	return false
+}
+
+func (h *Handler) handleListRefunds(w http.ResponseWriter, r *http.Request) {
+	orderID, err := uuid.Parse(chi.URLParam(r, "orderID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	refunds, err := h.store.ListRefundsByOrder(orderID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, refunds)
+}
+
+// handleResolveRefund settles a refund that was left pending because the
+// provider's answer was lost, after an admin has checked the outcome with
+// the provider. Failing it releases the amount it reserved.
+func (h *Handler) handleResolveRefund(w http.ResponseWriter, r *http.Request) {
+	orderID, err := uuid.Parse(chi.URLParam(r, "orderID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+	refundID, err := uuid.Parse(chi.URLParam(r, "refundID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid refund ID"))
+		return
+	}
+
+	var input types.ResolveRefundPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	refunds, err := h.store.ListRefundsByOrder(orderID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !slices.ContainsFunc(refunds, func(refund types.Refund) bool { return refund.ID == refundID }) {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("refund not found"))
+		return
+	}
+
+	raw, _ := json.Marshal(map[string]string{
+		"resolved_by": types.UserIDFromContext(r.Context()).String(),
+		"note":        input.Note,
+	})
+	refund, err := h.finishRefund(refundID, &RefundResult{Status: input.Status, Raw: raw})
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("refund is no longer pending"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, refund)
+}
+
+// handleRefundCallback receives the result of an asynchronous refund.
+func (h *Handler) handleRefundCallback(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		provider, err := h.providers.Get(name)
+		if err != nil {
+			utils.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+
+		res, err := provider.ParseRefundCallback(body)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		accepted := map[string]any{"ResultCode": 0, "ResultDesc": "Accepted"}
+
+		refund, err := h.store.GetRefundByReference(res.Reference)
+		if err == sql.ErrNoRows {
+			log.Printf("%s refund result for unknown reference %s", name, res.Reference)
+			utils.WriteJSON(w, http.StatusOK, accepted)
+			return
+		}
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if _, err := h.finishRefund(refund.ID, res); err == sql.ErrNoRows {
+			log.Printf("duplicate %s refund result for %s", name, res.Reference)
+		} else if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, accepted)
+	}
+}
+
+// finishRefund records the final result of a pending refund and carries a
+// successful one over to the order. It returns sql.ErrNoRows if the refund
+// was already finished.
+func (h *Handler) finishRefund(id uuid.UUID, res *RefundResult) (*types.Refund, error) {
+	refund, err := h.store.CompleteRefund(id, res.Status, res.Raw)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("refund %s of %s for order %s: %s", refund.ID, refund.Amount, refund.OrderID, refund.Status)
+
+	if refund.Status == types.PaymentStatusSuccess {
+		// the money has moved either way, so only log a stale order status
+		if err := h.applyRefundToOrder(refund); err != nil {
+			log.Printf("updating order %s after refund %s: %v", refund.OrderID, refund.ID, err)
+		}
+	}
+	return refund, nil
+}
+
+// applyRefundToOrder moves the order to refunded or partially_refunded.
+// Cancelled orders keep their status and only lose the refund flag once
+// everything has been returned, and paid orders keep theirs after a
+// partial refund so they can still be shipped.
+func (h *Handler) applyRefundToOrder(refund *types.Refund) error {
+	captured, refunded, err := h.store.RefundTotals(refund.OrderID)
+	if err != nil {
+		return err
+	}
+	full := refunded.Amount >= captured.Amount
+
+	order, err := h.orderStore.GetOrderWithItemsByID(refund.OrderID)
+	if err != nil {
+		return err
+	}
+
+	if order.Order.Status == types.OrderStatusCancelled {
+		if full {
+			return h.store.ClearNeedsRefund(refund.OrderID)
+		}
+		return nil
+	}
+
+	status := types.OrderStatusPartiallyRefunded
+	if full {
+		status = types.OrderStatusRefunded
+	} else if order.Order.Status == types.OrderStatusPaid {
+		return nil
+	}
+
+	note := fmt.Sprintf("refunded %s", refund.Amount)
+	if refund.Reason != "" {
+		note += ": " + refund.Reason
+	}
+	_, err = h.orderStore.TransitionOrderStatus(refund.OrderID, status, refund.ActorID, note)
+	return err
+}
@@ -0,0 +1,288 @@
+package payment
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/types"
+)
+
+// captured records a successful M-Pesa payment for the order and marks
+// the order paid.
+func (tt *paymentTest) captured(t *testing.T) *types.Payment {
+	t.Helper()
+
+	pay := &types.Payment{
+		ID:                uuid.New(),
+		OrderID:           tt.order.ID,
+		Amount:            tt.order.Total,
+		Provider:          types.PaymentProviderMpesa,
+		Status:            types.PaymentStatusSuccess,
+		CheckoutRequestID: "ws_CO_paid",
+		MpesaReceipt:      "RCPTPAID",
+		Phone:             "254712345678",
+	}
+	if err := tt.store.CreatePayment(pay); err != nil {
+		t.Fatal(err)
+	}
+	tt.orders.orders[tt.order.ID].Status = types.OrderStatusPaid
+	return pay
+}
+
+// refund asks for a refund of the order as an admin would.
+func (tt *paymentTest) refund(body string) *httptest.ResponseRecorder {
+	path := "/orders/" + tt.order.ID.String() + "/refunds"
+	return tt.as("/orders/{orderID}/refunds", tt.h.handleCreateRefund, path, body)
+}
+
+// pendingRefund starts a full refund and returns it as stored.
+func (tt *paymentTest) pendingRefund(t *testing.T) types.Refund {
+	t.Helper()
+
+	rec := tt.refund(`{"reason":"damaged"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("refund: status %d: %s", rec.Code, rec.Body)
+	}
+	var refund types.Refund
+	if err := json.Unmarshal(rec.Body.Bytes(), &refund); err != nil {
+		t.Fatal(err)
+	}
+	return tt.store.refund(refund.ID)
+}
+
+// refundResult builds a Daraja reversal or B2C result.
+func refundResult(conversationID string, code int) []byte {
+	b, _ := json.Marshal(map[string]any{"Result": map[string]any{
+		"ResultCode":               code,
+		"ResultDesc":               "result",
+		"OriginatorConversationID": "orig",
+		"ConversationID":           conversationID,
+		"TransactionID":            "TX1",
+	}})
+	return b
+}
+
+func TestMpesaRefundResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		code       int
+		wantRefund string
+		wantMoves  []string
+	}{
+		{"success", "/payments/mpesa/refund/result", 0, types.PaymentStatusSuccess, []string{types.OrderStatusRefunded}},
+		{"failed", "/payments/mpesa/refund/result", 2001, types.PaymentStatusFailed, nil},
+		{"timeout", "/payments/mpesa/refund/timeout", 1, types.PaymentStatusFailed, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newMpesaTest(t, testCallbackToken)
+			tt.captured(t)
+			refund := tt.pendingRefund(t)
+
+			rec := tt.post(tc.path, testCallbackToken, refundResult(refund.ProviderReference, tc.code))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("result: status %d: %s", rec.Code, rec.Body)
+			}
+
+			if got := tt.store.refund(refund.ID); got.Status != tc.wantRefund {
+				t.Errorf("refund %s, want %s", got.Status, tc.wantRefund)
+			}
+			if got := tt.orders.transitions(); !slices.Equal(got, tc.wantMoves) {
+				t.Errorf("order transitions %v, want %v", got, tc.wantMoves)
+			}
+		})
+	}
+}
+
+func TestMpesaRefundResultToken(t *testing.T) {
+	for _, path := range []string{"/payments/mpesa/refund/result", "/payments/mpesa/refund/timeout"} {
+		for _, token := range []string{"", "guess"} {
+			t.Run(path+"?token="+token, func(t *testing.T) {
+				tt := newMpesaTest(t, testCallbackToken)
+				tt.captured(t)
+				refund := tt.pendingRefund(t)
+
+				// a forged failure would free the reserved amount
+				rec := tt.post(path, token, refundResult(refund.ProviderReference, 2001))
+				if rec.Code != http.StatusUnauthorized {
+					t.Fatalf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+				}
+				if got := tt.store.refund(refund.ID); got.Status != types.PaymentStatusPending {
+					t.Errorf("refund %s after a rejected result", got.Status)
+				}
+				if rec := tt.refund(`{"reason":"again"}`); rec.Code != http.StatusUnprocessableEntity {
+					t.Errorf("second refund: status %d, want the amount still reserved", rec.Code)
+				}
+			})
+		}
+	}
+}
+
+func TestMpesaRefundProviderError(t *testing.T) {
+	tests := []struct {
+		fault      string
+		wantStatus int
+		wantRefund string
+	}{
+		// the request may have gone through
+		{"hang", http.StatusBadGateway, types.PaymentStatusPending},
+		{"drop", http.StatusBadGateway, types.PaymentStatusPending},
+		{"500", http.StatusBadGateway, types.PaymentStatusPending},
+		{"503", http.StatusBadGateway, types.PaymentStatusPending},
+		// Daraja answered and refused it
+		{"400", http.StatusBadGateway, types.PaymentStatusFailed},
+		{"rejected", http.StatusBadGateway, types.PaymentStatusFailed},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.fault, func(t *testing.T) {
+			tt := newMpesaTest(t, testCallbackToken)
+			pay := tt.captured(t)
+			tt.daraja.setAsyncFault(tc.fault)
+
+			rec := tt.refund(`{"reason":"damaged"}`)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+
+			refunds, _ := tt.store.ListRefundsByOrder(tt.order.ID)
+			if len(refunds) != 1 || refunds[0].Status != tc.wantRefund {
+				t.Fatalf("refunds %+v, want one %s", refunds, tc.wantRefund)
+			}
+
+			// a pending refund keeps the whole payment reserved
+			tt.daraja.setAsyncFault("")
+			rec = tt.refund(`{"reason":"again"}`)
+			wantAgain := http.StatusAccepted
+			if tc.wantRefund == types.PaymentStatusPending {
+				wantAgain = http.StatusUnprocessableEntity
+			}
+			if rec.Code != wantAgain {
+				t.Errorf("second refund of %s: status %d, want %d", pay.Amount, rec.Code, wantAgain)
+			}
+		})
+	}
+}
+
+func TestMpesaRefundInvalid(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	tt.captured(t)
+
+	// partial M-Pesa refunds go out as B2C, which takes whole shillings
+	rec := tt.refund(`{"amount":"10.50","reason":"partial"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	refunds, _ := tt.store.ListRefundsByOrder(tt.order.ID)
+	if len(refunds) != 1 || refunds[0].Status != types.PaymentStatusFailed {
+		t.Errorf("refunds %+v, want one failed", refunds)
+	}
+}
+
+func TestMpesaRefundCancelled(t *testing.T) {
+	tests := []struct {
+		name     string
+		captured bool
+		want     int
+	}{
+		// paid after the order was cancelled, before it could be flagged
+		{"captured without the flag", true, http.StatusAccepted},
+		{"nothing captured", false, http.StatusConflict},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt := newMpesaTest(t, testCallbackToken)
+			if tc.captured {
+				tt.captured(t)
+			}
+			tt.orders.orders[tt.order.ID].Status = types.OrderStatusCancelled
+
+			if rec := tt.refund(`{"reason":"cancelled"}`); rec.Code != tc.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestMpesaRefundRecordsReversedAmount(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	tt.captured(t)
+
+	refund := tt.pendingRefund(t)
+
+	// the order total of 1000.50 was charged, and is reversed, as 1001
+	reversal := tt.daraja.requests["/mpesa/reversal/v1/request"]
+	if len(reversal) != 1 || reversal[0]["Amount"] != float64(1001) {
+		t.Fatalf("reversal requests %v, want one of 1001", reversal)
+	}
+	if refund.Amount.Amount != 100100 {
+		t.Errorf("refund recorded as %s, want the 1001 sent", refund.Amount)
+	}
+}
+
+// resolve settles a pending refund as an admin would.
+func (tt *paymentTest) resolve(refundID uuid.UUID, body string) *httptest.ResponseRecorder {
+	path := "/orders/" + tt.order.ID.String() + "/refunds/" + refundID.String() + "/resolve"
+	return tt.as("/orders/{orderID}/refunds/{refundID}/resolve", tt.h.handleResolveRefund, path, body)
+}
+
+func TestMpesaRefundResolve(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	tt.captured(t)
+	tt.daraja.setAsyncFault("hang")
+	if rec := tt.refund(`{"reason":"damaged"}`); rec.Code != http.StatusBadGateway {
+		t.Fatalf("refund: status %d: %s", rec.Code, rec.Body)
+	}
+	tt.daraja.setAsyncFault("")
+	refunds, _ := tt.store.ListRefundsByOrder(tt.order.ID)
+	lost := refunds[0]
+
+	if rec := tt.resolve(uuid.New(), `{"status":"failed","note":"x"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown refund: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := tt.resolve(lost.ID, `{"status":"failed"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("without a note: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// the reversal never reached M-Pesa, so the amount can be refunded again
+	if rec := tt.resolve(lost.ID, `{"status":"failed","note":"not in the M-Pesa org portal"}`); rec.Code != http.StatusOK {
+		t.Fatalf("resolve: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := tt.store.refund(lost.ID); got.Status != types.PaymentStatusFailed {
+		t.Errorf("refund %s, want failed", got.Status)
+	}
+	if rec := tt.resolve(lost.ID, `{"status":"success","note":"again"}`); rec.Code != http.StatusConflict {
+		t.Errorf("resolving twice: status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if rec := tt.refund(`{"reason":"damaged"}`); rec.Code != http.StatusAccepted {
+		t.Errorf("refund after resolving: status %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+}
+
+func TestMpesaPartialRefundBeforeShipping(t *testing.T) {
+	tt := newMpesaTest(t, testCallbackToken)
+	tt.captured(t)
+
+	rec := tt.refund(`{"amount":"500","reason":"one item out of stock"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("refund: status %d: %s", rec.Code, rec.Body)
+	}
+	var refund types.Refund
+	json.Unmarshal(rec.Body.Bytes(), &refund)
+
+	tt.post("/payments/mpesa/refund/result", testCallbackToken, refundResult(refund.ProviderReference, 0))
+
+	if got := tt.store.refund(refund.ID); got.Status != types.PaymentStatusSuccess {
+		t.Fatalf("refund %s, want success", got.Status)
+	}
+	if got := tt.orders.status(tt.order.ID); got != types.OrderStatusPaid || len(tt.orders.transitions()) != 0 {
+		t.Errorf("order %s after %v, want it left paid so it can ship", got, tt.orders.transitions())
+	}
+}
@@ -1,38 +1,236 @@
 package payment
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/services/auth"
+	"github.com/kimenyu/executive/services/payment/mpesa"
 	"github.com/kimenyu/executive/types"
 	"github.com/kimenyu/executive/utils"
 )
 
 type Handler struct {
-	store      *Store
+	store      types.PaymentStore
 	orderStore types.OrderStore
+	userStore  types.UserStore
+	providers  *Registry
+	reconciler *Reconciler
 }
 
-func NewHandler(store *Store, orderStore types.OrderStore) *Handler {
-	return &Handler{store: store, orderStore: orderStore}
+func NewHandler(store types.PaymentStore, orderStore types.OrderStore, userStore types.UserStore, providers *Registry, reconciler *Reconciler) *Handler {
+	return &Handler{store: store, orderStore: orderStore, userStore: userStore, providers: providers, reconciler: reconciler}
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
-	r.Post("/payments/confirm", h.handleConfirm)
+	notifyKeys := SigningKeys(configs.Envs.NodeNotifySecret, configs.Envs.NodeNotifySecretPrevious)
+	r.With(VerifySignature(notifyKeys, 5*time.Minute)).Post("/payments/confirm", h.handleConfirm)
+
+	// Daraja cannot sign, so its callback URLs carry a secret token
+	r.Group(func(r chi.Router) {
+		r.Use(RequireToken(configs.Envs.MpesaCallbackToken))
+		r.Post("/payments/mpesa/callback", h.handleCallback(types.PaymentProviderMpesa))
+		r.Post("/payments/mpesa/refund/result", h.handleRefundCallback(types.PaymentProviderMpesa))
+		r.Post("/payments/mpesa/refund/timeout", h.handleRefundCallback(types.PaymentProviderMpesa))
+	})
+
+	cardKeys := SigningKeys(configs.Envs.CardWebhookSecret, configs.Envs.CardWebhookSecretPrevious)
+	r.With(VerifySignature(cardKeys, 5*time.Minute)).Post("/payments/card/callback", h.handleCallback(types.PaymentProviderCard))
+
+	r.Group(func(r chi.Router) {
+		r.Use(auth.WithJWTAuth(h.userStore))
+		r.Post("/orders/{orderID}/pay", h.handlePay)
+		r.Post("/orders/{orderID}/pay/mpesa", h.handlePayWithMpesa)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(auth.WithJWTAuth(h.userStore))
+		r.Use(auth.RequireRole(types.RoleAdmin))
+		r.Post("/payments/reconcile", h.handleReconcile)
+		r.Post("/orders/{orderID}/refunds", h.handleCreateRefund)
+		r.Get("/orders/{orderID}/refunds", h.handleListRefunds)
+		r.Post("/orders/{orderID}/refunds/{refundID}/resolve", h.handleResolveRefund)
+	})
+}
+
+// handleReconcile runs a reconciliation pass immediately instead of
+// waiting for the background worker.
+func (h *Handler) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	report, err := h.reconciler.ReconcileOnce(r.Context())
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, report)
+}
+
+// handlePayWithMpesa is kept for clients built against the M-Pesa only
+// endpoint; it is handlePay with the provider fixed to M-Pesa.
+func (h *Handler) handlePayWithMpesa(w http.ResponseWriter, r *http.Request) {
+	var input types.MpesaPayPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.pay(w, r, types.PayOrderPayload{Provider: types.PaymentProviderMpesa, Phone: input.Phone})
+}
+
+// handlePay starts a payment for one of the customer's pending orders with
+// the provider picked at checkout, or another one given in the body. The
+// amount always comes from the order, never from the client.
+func (h *Handler) handlePay(w http.ResponseWriter, r *http.Request) {
+	var input types.PayOrderPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.pay(w, r, input)
+}
+
+func (h *Handler) pay(w http.ResponseWriter, r *http.Request, input types.PayOrderPayload) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	orderID, err := uuid.Parse(chi.URLParam(r, "orderID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	order, err := h.orderStore.GetOrderWithItemsByID(orderID)
+	if err == sql.ErrNoRows || (err == nil && order.Order.UserID != userID) {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if order.Order.Status != types.OrderStatusPending {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("order is %s, only pending orders can be paid", order.Order.Status))
+		return
+	}
+
+	name := input.Provider
+	if name == "" {
+		name = order.Order.PaymentProvider
+	}
+	provider, err := h.providers.Get(name)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if name != order.Order.PaymentProvider {
+		if err := h.orderStore.SetPaymentProvider(order.Order.ID, name); err == sql.ErrNoRows {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("order is no longer pending"))
+			return
+		} else if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// cash is collected once, on delivery; a second push or charge while
+	// one is outstanding could take the money twice
+	existing, err := h.store.GetPendingPayment(order.Order.ID, name)
+	if err == nil {
+		if name == types.PaymentProviderCOD {
+			utils.WriteJSON(w, http.StatusAccepted, map[string]any{"payment": existing})
+		} else {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("a %s payment for this order is already pending", name))
+		}
+		return
+	} else if err != sql.ErrNoRows {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// record the attempt first so a callback can never arrive for a
+	// payment we do not know about
+	pay := &types.Payment{
+		ID:        uuid.New(),
+		OrderID:   order.Order.ID,
+		Amount:    order.Order.Total,
+		Provider:  name,
+		Status:    types.PaymentStatusPending,
+		Phone:     input.Phone,
+		CreatedAt: time.Now(),
+	}
+	if err := h.store.CreatePayment(pay); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, err := provider.Initiate(r.Context(), pay, PaymentRequest{Phone: input.Phone})
+	if err != nil {
+		pay.Status = types.PaymentStatusFailed
+		if cerr := h.store.CompletePayment(pay); cerr != nil {
+			log.Printf("marking payment %s failed: %v", pay.ID, cerr)
+		}
+
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrInvalidPayment) {
+			status = http.StatusBadRequest
+		}
+		utils.WriteError(w, status, err)
+		return
+	}
+
+	if res.Reference != "" {
+		pay.CheckoutRequestID = res.Reference
+		pay.MerchantRequestID = res.MerchantReference
+		if err := h.store.SetCheckoutRequest(pay.ID, res.Reference, res.MerchantReference); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// some gateways settle straight away
+	if res.Status != types.PaymentStatusPending {
+		if err := settle(h.store, pay, res); err != nil && err != sql.ErrNoRows {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, map[string]any{
+		"payment":          pay,
+		"customer_message": res.Message,
+		"redirect_url":     res.RedirectURL,
+	})
 }
 
 // payload matches what Node sends
 type confirmPayload struct {
-	OrderID         string          `json:"order_id"`
-	Status          string          `json:"status"`
-	Amount          float64         `json:"amount"`
-	Provider        string          `json:"provider"`
-	CheckoutRequest string          `json:"checkout_request_id"`
+	OrderID         string          `json:"order_id" validate:"required"`
+	Status          string          `json:"status" validate:"required,oneof=success failed"`
+	Amount          types.Money     `json:"amount"`
+	Provider        string          `json:"provider" validate:"required,oneof=mpesa card cod"`
+	CheckoutRequest string          `json:"checkout_request_id" validate:"required"`
 	MerchantRequest string          `json:"merchant_request_id"`
 	MpesaReceipt    string          `json:"mpesa_receipt"`
 	Phone           string          `json:"phone"`
@@ -40,15 +238,14 @@ type confirmPayload struct {
 }
 
 func (h *Handler) handleConfirm(w http.ResponseWriter, r *http.Request) {
-	// verify secret
-	expected := os.Getenv("NODE_NOTIFY_SECRET")
-	if r.Header.Get("X-Node-Notify-Secret") != expected {
-		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+	// the signature was checked by VerifySignature
+	var p confirmPayload
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	var p confirmPayload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+	if err := utils.Validate.Struct(p); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
@@ -65,12 +262,30 @@ func (h *Handler) handleConfirm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if p.Amount != order.Order.Total {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("payment amount %.2f does not match order total %.2f", p.Amount, order.Order.Total))
+	if _, err := h.providers.Get(p.Provider); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	// create payment record
+	// providers may charge more than the total, M-Pesa rounds it up
+	charged := chargedAmount(&types.Payment{Amount: order.Order.Total, Provider: p.Provider})
+	if !p.Amount.Equal(charged) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("payment amount %s does not match the %s charged for the order", p.Amount, charged))
+		return
+	}
+
+	// a receipt can only ever settle one payment
+	if p.MpesaReceipt != "" {
+		existing, err := h.store.GetPaymentByReceipt(p.MpesaReceipt)
+		if err == nil && existing.CheckoutRequestID != p.CheckoutRequest {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("receipt %s already recorded", p.MpesaReceipt))
+			return
+		} else if err != nil && err != sql.ErrNoRows {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
 	pay := &types.Payment{
 		ID:                uuid.New(),
 		OrderID:           order.Order.ID,
@@ -85,19 +300,147 @@ func (h *Handler) handleConfirm(w http.ResponseWriter, r *http.Request) {
 		CreatedAt:         time.Now(),
 	}
 
-	if err := h.store.CreatePayment(pay); err != nil {
+	// retries and duplicate callbacks land on the same row and only a
+	// pending payment can move to success or failed
+	pay, changed, err := h.store.UpsertPayment(pay)
+	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	// update order state if success
-	if p.Status == "success" {
-		if err := h.orderStore.UpdateOrderStatus(order.Order.ID, "paid"); err != nil {
+	if !changed {
+		log.Printf("duplicate confirmation for %s, payment already %s", p.CheckoutRequest, pay.Status)
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "duplicate"})
+		return
+	}
+
+	log.Printf("payment %s for order %s confirmed: %s", pay.ID, pay.OrderID, pay.Status)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleCallback receives payment results pushed by a provider. The
+// payment row created when the payment was started maps the provider's
+// reference back to the order.
+func (h *Handler) handleCallback(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		provider, err := h.providers.Get(name)
+		if err != nil {
+			utils.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+
+		res, err := provider.ParseCallback(body)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// providers do not act on our answer, so anything we cannot use is
+		// logged and acknowledged; Daraja expects this body, the others
+		// only look at the status code
+		accepted := map[string]any{"ResultCode": 0, "ResultDesc": "Accepted"}
+
+		pay, err := h.store.GetPaymentByCheckoutID(res.Reference)
+		if err == sql.ErrNoRows {
+			log.Printf("%s callback for unknown reference %s", name, res.Reference)
+			utils.WriteJSON(w, http.StatusOK, accepted)
+			return
+		}
+		if err != nil {
 			utils.WriteError(w, http.StatusInternalServerError, err)
 			return
 		}
+
+		if pay.Status != types.PaymentStatusPending || res.Status == types.PaymentStatusPending {
+			log.Printf("%s callback for %s ignored, payment is %s", name, res.Reference, pay.Status)
+			utils.WriteJSON(w, http.StatusOK, accepted)
+			return
+		}
+
+		res, err = confirmCallback(r.Context(), provider, pay, res)
+		if err != nil {
+			// the reconciler asks again later
+			log.Printf("%s callback for %s left pending, confirming it failed: %v", name, pay.CheckoutRequestID, err)
+			utils.WriteJSON(w, http.StatusOK, accepted)
+			return
+		}
+		if res.Status == types.PaymentStatusPending {
+			utils.WriteJSON(w, http.StatusOK, accepted)
+			return
+		}
+
+		if err := settle(h.store, pay, res); err == sql.ErrNoRows {
+			log.Printf("%s callback for %s raced with another update", name, res.Reference)
+			utils.WriteJSON(w, http.StatusOK, accepted)
+			return
+		} else if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		log.Printf("%s payment %s for order %s: %s (%s)", name, pay.ID, pay.OrderID, pay.Status, res.Message)
+		utils.WriteJSON(w, http.StatusOK, accepted)
 	}
-	fmt.Printf("Received confirmPayload.OrderID: %v\n", p.OrderID)
+}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+// confirmCallback checks a result pushed to a callback, which anyone who
+// knows the payment's reference could have sent. A success must carry
+// exactly the amount that was charged, or it counts as a failure, and the
+// provider's own answer to Query must agree with it. Until it does the
+// result comes back pending and the payment is left for a later callback
+// or the reconciler.
+func confirmCallback(ctx context.Context, provider PaymentProvider, pay *types.Payment, res *PaymentResult) (*PaymentResult, error) {
+	if res.Status == types.PaymentStatusSuccess && !res.Amount.Equal(chargedAmount(pay)) {
+		log.Printf("%s amount mismatch for %s: paid %s, expected %s", pay.Provider, pay.CheckoutRequestID, res.Amount, chargedAmount(pay))
+		res.Status = types.PaymentStatusFailed
+	}
+
+	confirmed, err := provider.Query(ctx, pay)
+	if err != nil {
+		return nil, err
+	}
+	if confirmed.Status != res.Status {
+		if confirmed.Status != types.PaymentStatusPending {
+			log.Printf("%s callback for %s says %s, the provider says %s", pay.Provider, pay.CheckoutRequestID, res.Status, confirmed.Status)
+		}
+		return &PaymentResult{Status: types.PaymentStatusPending, Reference: res.Reference}, nil
+	}
+	return res, nil
+}
+
+// chargedAmount is what the provider was asked to collect for pay. M-Pesa
+// only takes whole shillings, so it charged the total rounded up.
+func chargedAmount(pay *types.Payment) types.Money {
+	if pay.Provider == types.PaymentProviderMpesa {
+		return types.Money{Amount: int64(mpesa.ChargeAmount(pay.Amount)) * 100, Currency: pay.Amount.Currency}
+	}
+	return pay.Amount
+}
+
+// settle records the final result of a pending payment, which marks the
+// order paid on success or flags it for a refund if it was cancelled in
+// the meantime. A success reporting any other amount than was charged
+// fails the payment; results without an amount are only settled when they
+// come from our own query to the provider. It returns sql.ErrNoRows if the
+// payment was settled in the meantime.
+func settle(store types.PaymentStore, pay *types.Payment, res *PaymentResult) error {
+	pay.Status = res.Status
+	if res.Status == types.PaymentStatusSuccess && !res.Amount.IsZero() && !res.Amount.Equal(chargedAmount(pay)) {
+		log.Printf("%s amount mismatch for %s: paid %s, expected %s", pay.Provider, pay.CheckoutRequestID, res.Amount, chargedAmount(pay))
+		pay.Status = types.PaymentStatusFailed
+	}
+	pay.MpesaReceipt = res.Receipt
+	if res.Phone != "" {
+		pay.Phone = res.Phone
+	}
+	pay.Metadata = res.Raw
+
+	return store.CompletePayment(pay)
 }
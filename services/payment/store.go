@@ -1,9 +1,17 @@
 package payment
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/kimenyu/executive/types"
+	"github.com/lib/pq"
 )
 
 type Store struct {
@@ -15,19 +23,353 @@ func NewStore(db *sql.DB) *Store { return &Store{db: db} }
 func (s *Store) CreatePayment(p *types.Payment) error {
 	_, err := s.db.Exec(
 		`INSERT INTO payments (id, order_id, amount, provider, status, checkout_request_id, merchant_request_id, mpesa_receipt, phone, metadata, created_at)
-         VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`,
-		p.ID, p.OrderID, p.Amount, p.Provider, p.Status, p.CheckoutRequestID, p.MerchantRequestID, p.MpesaReceipt, p.Phone, p.Metadata, p.CreatedAt,
+         VALUES ($1,$2,$3,$4,$5,NULLIF($6,''),NULLIF($7,''),NULLIF($8,''),NULLIF($9,''),$10,$11)`,
+		p.ID, p.OrderID, p.Amount, p.Provider, p.Status, p.CheckoutRequestID, p.MerchantRequestID, p.MpesaReceipt, p.Phone, nullJSON(p.Metadata), p.CreatedAt,
 	)
 	return err
 }
 
 func (s *Store) GetPaymentByCheckoutID(checkout string) (*types.Payment, error) {
-	row := s.db.QueryRow(`SELECT id, order_id, amount, provider, status, checkout_request_id, merchant_request_id, mpesa_receipt, phone, metadata, created_at FROM payments WHERE checkout_request_id=$1`, checkout)
+	row := s.db.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE checkout_request_id=$1`, checkout)
+	return scanPayment(row)
+}
+
+func (s *Store) GetPaymentByReceipt(receipt string) (*types.Payment, error) {
+	row := s.db.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE mpesa_receipt=$1`, receipt)
+	return scanPayment(row)
+}
+
+// UpsertPayment records a payment result keyed by its checkout request ID.
+// An existing row is only updated while it is pending, so results can move
+// a payment forward but never back. changed is false when nothing was
+// written, and the stored payment is returned instead. A success is
+// applied to the order in the same transaction, as in CompletePayment.
+func (s *Store) UpsertPayment(p *types.Payment) (*types.Payment, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		`INSERT INTO payments (id, order_id, amount, provider, status, checkout_request_id, merchant_request_id, mpesa_receipt, phone, metadata, created_at)
+         VALUES ($1,$2,$3,$4,$5,NULLIF($6,''),NULLIF($7,''),NULLIF($8,''),NULLIF($9,''),$10,$11)
+         ON CONFLICT (checkout_request_id) DO UPDATE
+         SET status = EXCLUDED.status,
+             merchant_request_id = COALESCE(EXCLUDED.merchant_request_id, payments.merchant_request_id),
+             mpesa_receipt = COALESCE(EXCLUDED.mpesa_receipt, payments.mpesa_receipt),
+             phone = COALESCE(EXCLUDED.phone, payments.phone),
+             metadata = COALESCE(EXCLUDED.metadata, payments.metadata)
+         WHERE payments.status = 'pending' AND EXCLUDED.status <> 'pending'
+         RETURNING `+paymentColumns,
+		p.ID, p.OrderID, p.Amount, p.Provider, p.Status, p.CheckoutRequestID, p.MerchantRequestID, p.MpesaReceipt, p.Phone, nullJSON(p.Metadata), p.CreatedAt,
+	)
+
+	stored, err := scanPayment(row)
+	if err == sql.ErrNoRows {
+		existing, err := s.GetPaymentByCheckoutID(p.CheckoutRequestID)
+		return existing, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if stored.Status == types.PaymentStatusSuccess {
+		if err := applyPaymentToOrder(ctx, tx, stored); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return stored, true, nil
+}
+
+// CompletePayment records the final result of a pending payment. It
+// returns sql.ErrNoRows if the payment is no longer pending. A success is
+// applied to the order in the same transaction, so money is never
+// captured without the order knowing.
+func (s *Store) CompletePayment(p *types.Payment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE payments
+		 SET status = $1, mpesa_receipt = NULLIF($2, ''), phone = COALESCE(NULLIF($3, ''), phone), metadata = $4
+		 WHERE id = $5 AND status = 'pending'`,
+		p.Status, p.MpesaReceipt, p.Phone, nullJSON(p.Metadata), p.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if p.Status == types.PaymentStatusSuccess {
+		if err := applyPaymentToOrder(ctx, tx, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// applyPaymentToOrder moves the pending order of a successful payment to
+// paid. An order that moved on in the meantime, e.g. was cancelled while
+// the customer was still paying, is flagged for a refund instead.
+func applyPaymentToOrder(ctx context.Context, tx *sql.Tx, p *types.Payment) error {
+	var status string
+	err := tx.QueryRowContext(ctx, `SELECT status FROM orders WHERE id = $1 FOR UPDATE`, p.OrderID).Scan(&status)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if status != types.OrderStatusPending {
+		log.Printf("payment %s received for order %s which is %s, flagging it for a refund", p.ID, p.OrderID, status)
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET needs_refund = true, updated_at = $1 WHERE id = $2`, now, p.OrderID)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3`,
+		types.OrderStatusPaid, now, p.OrderID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO order_status_history (id, order_id, from_status, to_status, note, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		uuid.New(), p.OrderID, status, types.OrderStatusPaid, "payment confirmed", now)
+	return err
+}
+
+// SetCheckoutRequest links a pending payment to the Daraja request that
+// was sent for it, so the callback can find it.
+func (s *Store) SetCheckoutRequest(id uuid.UUID, checkoutRequestID, merchantRequestID string) error {
+	_, err := s.db.Exec(`UPDATE payments SET checkout_request_id = $1, merchant_request_id = $2 WHERE id = $3`,
+		checkoutRequestID, merchantRequestID, id)
+	return err
+}
+
+// GetPendingPayment returns the oldest pending payment of an order made
+// with provider. Payments flagged for review are left to whoever reviews
+// them, so they do not keep the customer from paying again.
+func (s *Store) GetPendingPayment(orderID uuid.UUID, provider string) (*types.Payment, error) {
+	row := s.db.QueryRow(`SELECT `+paymentColumns+` FROM payments
+		WHERE order_id = $1 AND provider = $2 AND status = 'pending' AND NOT needs_review
+		ORDER BY created_at
+		LIMIT 1`, orderID, provider)
+	return scanPayment(row)
+}
+
+// ListStalePendingPayments returns up to limit payments made with one of
+// providers that have been pending since before cutoff, oldest first.
+// Payments flagged for review are skipped.
+func (s *Store) ListStalePendingPayments(cutoff time.Time, providers []string, limit int) ([]types.Payment, error) {
+	rows, err := s.db.Query(
+		`SELECT `+paymentColumns+` FROM payments
+		 WHERE status = 'pending' AND NOT needs_review AND created_at < $1 AND provider = ANY($2)
+		 ORDER BY created_at
+		 LIMIT $3`,
+		cutoff, pq.Array(providers), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []types.Payment
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
+
+// FlagPaymentForReview marks a pending payment for someone to check with
+// the provider by hand.
+func (s *Store) FlagPaymentForReview(id uuid.UUID) error {
+	_, err := s.db.Exec(`UPDATE payments SET needs_review = true WHERE id = $1 AND status = 'pending'`, id)
+	return err
+}
+
+const paymentColumns = `id, order_id, amount, provider, status, COALESCE(checkout_request_id, ''), COALESCE(merchant_request_id, ''),
+	COALESCE(mpesa_receipt, ''), COALESCE(phone, ''), metadata, needs_review, created_at`
+
+// scanPayment reads paymentColumns from a *sql.Row or *sql.Rows.
+func scanPayment(row interface{ Scan(...any) error }) (*types.Payment, error) {
 	var p types.Payment
 	var raw []byte
-	if err := row.Scan(&p.ID, &p.OrderID, &p.Amount, &p.Provider, &p.Status, &p.CheckoutRequestID, &p.MerchantRequestID, &p.MpesaReceipt, &p.Phone, &raw, &p.CreatedAt); err != nil {
+	if err := row.Scan(&p.ID, &p.OrderID, &p.Amount, &p.Provider, &p.Status, &p.CheckoutRequestID, &p.MerchantRequestID, &p.MpesaReceipt, &p.Phone, &raw, &p.NeedsReview, &p.CreatedAt); err != nil {
 		return nil, err
 	}
 	p.Metadata = raw
 	return &p, nil
 }
+
+// nullJSON keeps empty metadata out of the jsonb column.
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return []byte(raw)
+}
+
+var (
+	ErrRefundExceedsPayment = errors.New("refund exceeds the amount left on the payment")
+	ErrPaymentNotCaptured   = errors.New("payment has not been captured")
+)
+
+func (s *Store) GetPaymentByID(id uuid.UUID) (*types.Payment, error) {
+	row := s.db.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE id=$1`, id)
+	return scanPayment(row)
+}
+
+// GetCapturedPayment returns the latest successful payment of an order.
+func (s *Store) GetCapturedPayment(orderID uuid.UUID) (*types.Payment, error) {
+	row := s.db.QueryRow(`SELECT `+paymentColumns+` FROM payments
+		WHERE order_id = $1 AND status = 'success'
+		ORDER BY created_at DESC
+		LIMIT 1`, orderID)
+	return scanPayment(row)
+}
+
+// CreateRefund records a pending refund against a successful payment. A
+// zero amount refunds whatever is left. The payment row is locked while
+// pending and successful refunds are added up, so concurrent refunds can
+// never exceed the captured amount.
+func (s *Store) CreateRefund(r *types.Refund) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var captured types.Money
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT amount, status FROM payments WHERE id = $1 FOR UPDATE`, r.PaymentID).
+		Scan(&captured, &status)
+	if err != nil {
+		return err
+	}
+	if status != types.PaymentStatusSuccess {
+		return fmt.Errorf("%w: payment is %s", ErrPaymentNotCaptured, status)
+	}
+
+	var refunded types.Money
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM refunds
+		WHERE payment_id = $1 AND status IN ('pending', 'success')`, r.PaymentID).Scan(&refunded)
+	if err != nil {
+		return err
+	}
+
+	left := captured.Sub(refunded)
+	if r.Amount.IsZero() {
+		r.Amount = left
+	}
+	if r.Amount.Amount <= 0 || r.Amount.Amount > left.Amount {
+		return fmt.Errorf("%w: %s left", ErrRefundExceedsPayment, left)
+	}
+
+	r.Status = types.PaymentStatusPending
+	r.UpdatedAt = r.CreatedAt
+	_, err = tx.ExecContext(ctx, `INSERT INTO refunds (id, payment_id, order_id, amount, status, reason, actor_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9)`,
+		r.ID, r.PaymentID, r.OrderID, r.Amount, r.Status, r.Reason, r.ActorID, r.CreatedAt, r.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRefundReference links a pending refund to the provider's request and
+// records the amount the provider was asked to send.
+func (s *Store) SetRefundReference(id uuid.UUID, reference string, amount types.Money) error {
+	_, err := s.db.Exec(`UPDATE refunds SET provider_reference = NULLIF($1, ''), amount = $2, updated_at = $3 WHERE id = $4`,
+		reference, amount, time.Now(), id)
+	return err
+}
+
+// CompleteRefund records the final status of a pending refund and returns
+// it. It returns sql.ErrNoRows if the refund is no longer pending.
+func (s *Store) CompleteRefund(id uuid.UUID, status string, metadata json.RawMessage) (*types.Refund, error) {
+	row := s.db.QueryRow(`UPDATE refunds SET status = $1, metadata = COALESCE($2, metadata), updated_at = $3
+		WHERE id = $4 AND status = 'pending'
+		RETURNING `+refundColumns,
+		status, nullJSON(metadata), time.Now(), id)
+	return scanRefund(row)
+}
+
+func (s *Store) GetRefundByReference(reference string) (*types.Refund, error) {
+	row := s.db.QueryRow(`SELECT `+refundColumns+` FROM refunds WHERE provider_reference = $1`, reference)
+	return scanRefund(row)
+}
+
+func (s *Store) ListRefundsByOrder(orderID uuid.UUID) ([]types.Refund, error) {
+	rows, err := s.db.Query(`SELECT `+refundColumns+` FROM refunds WHERE order_id = $1 ORDER BY created_at`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []types.Refund{}
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, *r)
+	}
+	return refunds, rows.Err()
+}
+
+// RefundTotals returns how much of an order was captured and how much of
+// that has been refunded successfully.
+func (s *Store) RefundTotals(orderID uuid.UUID) (captured, refunded types.Money, err error) {
+	err = s.db.QueryRow(`SELECT
+			COALESCE((SELECT SUM(amount) FROM payments WHERE order_id = $1 AND status = 'success'), 0),
+			COALESCE((SELECT SUM(amount) FROM refunds WHERE order_id = $1 AND status = 'success'), 0)`,
+		orderID).Scan(&captured, &refunded)
+	return captured, refunded, err
+}
+
+// ClearNeedsRefund drops the refund flag of a cancelled order once its
+// money has been returned.
+func (s *Store) ClearNeedsRefund(orderID uuid.UUID) error {
+	_, err := s.db.Exec(`UPDATE orders SET needs_refund = false, updated_at = $1 WHERE id = $2`, time.Now(), orderID)
+	return err
+}
+
+const refundColumns = `id, payment_id, order_id, amount, status, COALESCE(reason, ''), COALESCE(provider_reference, ''),
+	actor_id, metadata, created_at, updated_at`
+
+func scanRefund(row interface{ Scan(...any) error }) (*types.Refund, error) {
+	var r types.Refund
+	var raw []byte
+	if err := row.Scan(&r.ID, &r.PaymentID, &r.OrderID, &r.Amount, &r.Status, &r.Reason, &r.ProviderReference,
+		&r.ActorID, &raw, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	r.Metadata = raw
+	return &r, nil
+}
@@ -0,0 +1,403 @@
+package product
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/types"
+	"github.com/kimenyu/executive/utils"
+)
+
+// Catalog file formats.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+var (
+	ErrUnknownFormat = errors.New("format must be csv or jsonl")
+	// wraps errors that reject a catalog file as a whole
+	ErrInvalidCatalog = errors.New("invalid catalog")
+)
+
+// catalogColumns is the CSV header of an export. Imports accept the
+// columns in any order; only sku, name and price are required.
+var catalogColumns = []string{"product_id", "sku", "name", "description", "price", "price_override", "category", "options", "quantity", "image"}
+
+// ImportCatalog reads a CSV or JSONL catalog, validates every row and
+// upserts the valid ones. Rows that can't be read or fail validation are
+// reported alongside those the store rejects.
+func ImportCatalog(store types.ProductStore, r io.Reader, format string, dryRun bool) (*types.ImportReport, error) {
+	var rows []types.CatalogRow
+	var rowErrors []types.ImportRowError
+	var err error
+	switch format {
+	case FormatCSV:
+		rows, rowErrors, err = decodeCSV(r)
+	case FormatJSONL:
+		rows, rowErrors, err = decodeJSONL(r)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a SKU listed twice would silently overwrite its first row
+	valid := make([]types.CatalogRow, 0, len(rows))
+	seen := make(map[string]int, len(rows))
+	for _, row := range rows {
+		if err := utils.Validate.Struct(row); err != nil {
+			rowErrors = append(rowErrors, types.ImportRowError{Line: row.Line, SKU: row.SKU, Error: err.Error()})
+			continue
+		}
+		if line, ok := seen[row.SKU]; ok {
+			rowErrors = append(rowErrors, types.ImportRowError{Line: row.Line, SKU: row.SKU,
+				Error: fmt.Sprintf("SKU already listed on line %d", line)})
+			continue
+		}
+		seen[row.SKU] = row.Line
+		valid = append(valid, row)
+	}
+
+	report, err := store.ImportProducts(valid, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	report.Rows += len(rowErrors)
+	report.Failed += len(rowErrors)
+	report.Errors = append(report.Errors, rowErrors...)
+	slices.SortStableFunc(report.Errors, func(a, b types.ImportRowError) int { return a.Line - b.Line })
+	return report, nil
+}
+
+// decodeCSV reads a CSV catalog with a header row. Unknown or missing
+// required columns reject the whole file; bad values only their row.
+func decodeCSV(r io.Reader) ([]types.CatalogRow, []types.ImportRowError, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("%w: empty file", ErrInvalidCatalog)
+	}
+	if err != nil {
+		return nil, nil, csvError(err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			// spreadsheet exports often start with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(catalogColumns, name) {
+			return nil, nil, fmt.Errorf("%w: unknown column %q", ErrInvalidCatalog, name)
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"sku", "name", "price"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("%w: missing column %q", ErrInvalidCatalog, name)
+		}
+	}
+
+	var rows []types.CatalogRow
+	var rowErrors []types.ImportRowError
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		// a wrong field count still returns the record and leaves the
+		// reader usable, other parse errors don't
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, nil, csvError(err)
+		}
+		line, _ := cr.FieldPos(0)
+		if err != nil {
+			rowErrors = append(rowErrors, types.ImportRowError{Line: line, Error: "wrong number of fields"})
+			continue
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row, err := csvRow(field)
+		row.Line = line
+		if err != nil {
+			rowErrors = append(rowErrors, types.ImportRowError{Line: line, SKU: row.SKU, Error: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+// csvError marks malformed CSV as an invalid catalog, leaving read errors
+// such as an oversized body as they are.
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return fmt.Errorf("%w: %v", ErrInvalidCatalog, err)
+	}
+	return err
+}
+
+// csvRow converts the text fields of a CSV record.
+func csvRow(field func(string) string) (types.CatalogRow, error) {
+	row := types.CatalogRow{
+		SKU:         field("sku"),
+		Name:        field("name"),
+		Description: field("description"),
+		Category:    field("category"),
+		Image:       field("image"),
+	}
+
+	if v := field("product_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return row, fmt.Errorf("invalid product_id")
+		}
+		row.ProductID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	price, err := types.ParseMoney(field("price"))
+	if err != nil {
+		return row, fmt.Errorf("invalid price")
+	}
+	row.Price = price
+
+	if v := field("price_override"); v != "" {
+		override, err := types.ParseMoney(v)
+		if err != nil {
+			return row, fmt.Errorf("invalid price_override")
+		}
+		row.PriceOverride = &override
+	}
+
+	if v := field("options"); v != "" {
+		if err := json.Unmarshal([]byte(v), &row.Options); err != nil {
+			return row, fmt.Errorf(`options must be a JSON object such as {"size":"M"}`)
+		}
+	}
+
+	if v := field("quantity"); v != "" {
+		quantity, err := strconv.Atoi(v)
+		if err != nil {
+			return row, fmt.Errorf("invalid quantity")
+		}
+		row.Quantity = &quantity
+	}
+
+	return row, nil
+}
+
+// maxJSONLine bounds a single JSONL row.
+const maxJSONLine = 1 << 20
+
+// decodeJSONL reads one JSON object per line, skipping blank lines.
+func decodeJSONL(r io.Reader) ([]types.CatalogRow, []types.ImportRowError, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxJSONLine)
+
+	var rows []types.CatalogRow
+	var rowErrors []types.ImportRowError
+	for line := 1; sc.Scan(); line++ {
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var row types.CatalogRow
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row); err != nil {
+			rowErrors = append(rowErrors, types.ImportRowError{Line: line, Error: err.Error()})
+			continue
+		}
+		row.Line = line
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return nil, nil, fmt.Errorf("%w: line longer than %d bytes", ErrInvalidCatalog, maxJSONLine)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return rows, rowErrors, nil
+}
+
+// ExportCatalog writes every variant to w in the given format, in the
+// shape ImportCatalog reads back.
+func ExportCatalog(store types.ProductStore, w io.Writer, format string) error {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(catalogColumns); err != nil {
+			return err
+		}
+		err := store.ExportProducts(func(row types.CatalogRow) error {
+			return cw.Write(csvRecord(row))
+		})
+		if err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		return store.ExportProducts(func(row types.CatalogRow) error {
+			return enc.Encode(row)
+		})
+
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// csvRecord lays out row in catalogColumns order.
+func csvRecord(row types.CatalogRow) []string {
+	var override, options string
+	if row.PriceOverride != nil {
+		override = row.PriceOverride.String()
+	}
+	if len(row.Options) > 0 {
+		b, _ := json.Marshal(row.Options)
+		options = string(b)
+	}
+	return []string{
+		row.ProductID.UUID.String(),
+		row.SKU,
+		row.Name,
+		row.Description,
+		row.Price.String(),
+		override,
+		row.Category,
+		options,
+		strconv.Itoa(*row.Quantity),
+		row.Image,
+	}
+}
+
+// catalogFormat takes the format from the format query parameter, falling
+// back to the request's Content-Type.
+func catalogFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format != FormatCSV && format != FormatJSONL {
+			return "", ErrUnknownFormat
+		}
+		return format, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV, nil
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return FormatJSONL, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// @Summary Import products
+// @Description Upsert products from a CSV file with a header row or from JSON Lines, matching variants by SKU. Columns: product_id, sku, name, description, price, price_override, category (slug or name), options (JSON object), quantity, image. Rows that fail are listed in the report and skipped; with dry_run=true nothing is saved.
+// @Tags Products
+// @Accept text/csv
+// @Accept application/x-ndjson
+// @Produce json
+// @Param format query string false "csv or jsonl, taken from Content-Type when omitted"
+// @Param dry_run query bool false "validate and report without saving"
+// @Success 200 {object} types.ImportReport
+// @Failure 400 {object} map[string]string
+// @Failure 413 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/import [post]
+
+func (h *Handler) handleImportProducts(w http.ResponseWriter, r *http.Request) {
+	format, err := catalogFormat(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid dry_run"))
+			return
+		}
+	}
+
+	// rows are read before anything is written, so a body that is cut off
+	// never imports half a file
+	r.Body = http.MaxBytesReader(w, r.Body, configs.Envs.ImportMaxBytes)
+	report, err := ImportCatalog(h.store, r.Body, format, dryRun)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			utils.WriteError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("catalog file is too large"))
+		case errors.Is(err, ErrInvalidCatalog):
+			utils.WriteError(w, http.StatusBadRequest, err)
+		default:
+			utils.WriteError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, report)
+}
+
+// @Summary Export products
+// @Description Stream every product variant as CSV or JSON Lines, in the format the import endpoint accepts
+// @Tags Products
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Param format query string false "csv (default) or jsonl"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/export [get]
+
+func (h *Handler) handleExportProducts(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatCSV
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	switch format {
+	case FormatCSV:
+	case FormatJSONL:
+		contentType = "application/x-ndjson"
+	default:
+		utils.WriteError(w, http.StatusBadRequest, ErrUnknownFormat)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	// the status is already sent, so a failure can only cut the file short
+	if err := ExportCatalog(h.store, w, format); err != nil {
+		log.Printf("product export failed: %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+package product
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/internal/blob"
+	"github.com/kimenyu/executive/types"
+	"github.com/kimenyu/executive/utils"
+)
+
+const (
+	maxImagesPerUpload = 10
+	// decoding allocates 4 bytes per pixel, so huge dimensions are refused
+	// before the image is decoded
+	maxImagePixels = 40_000_000
+)
+
+// imageExtensions lists the accepted upload types, detected from content.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var (
+	errUnsupportedImage = errors.New("images must be JPEG, PNG or GIF")
+	errImageTooLarge    = errors.New("image is too large")
+)
+
+// processedImage is an upload that passed the checks, with its thumbnail.
+type processedImage struct {
+	types.ProductImage
+	data      []byte
+	thumbnail []byte
+	thumbType string
+}
+
+// @Summary Upload product images
+// @Description Upload one or more JPEG, PNG or GIF images as multipart "images" fields. They are appended after the existing images; set "primary" to true to make the first upload the primary image. Thumbnails are generated
+// @Tags Products
+// @Accept multipart/form-data
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Param images formData file true "Image files"
+// @Param primary formData bool false "Make the first uploaded image primary"
+// @Success 201 {array} types.ProductImage
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 413 {object} map[string]string
+// @Failure 415 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/images [post]
+
+func (h *Handler) handleUploadImages(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.productParam(w, r)
+	if !ok {
+		return
+	}
+
+	maxBytes := configs.Envs.ImageMaxBytes
+	r.Body = http.MaxBytesReader(w, r.Body, maxImagesPerUpload*maxBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.WriteError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("upload is too large"))
+			return
+		}
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("no images uploaded"))
+		return
+	}
+	if len(files) > maxImagesPerUpload {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("at most %d images per upload", maxImagesPerUpload))
+		return
+	}
+
+	// check every file before storing any
+	processed := make([]*processedImage, 0, len(files))
+	for _, fh := range files {
+		img, err := processImage(productID, fh, maxBytes)
+		if err != nil {
+			utils.WriteError(w, imageStatus(err), fmt.Errorf("%s: %w", fh.Filename, err))
+			return
+		}
+		processed = append(processed, img)
+	}
+	processed[0].IsPrimary = r.FormValue("primary") == "true"
+
+	ctx := r.Context()
+	var stored []string
+	for _, img := range processed {
+		if err := h.blobs.Put(ctx, img.Key, img.data, img.ContentType); err != nil {
+			h.deleteBlobs(stored...)
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		stored = append(stored, img.Key)
+		if err := h.blobs.Put(ctx, img.ThumbnailKey, img.thumbnail, img.thumbType); err != nil {
+			h.deleteBlobs(stored...)
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		stored = append(stored, img.ThumbnailKey)
+	}
+
+	images := make([]types.ProductImage, len(processed))
+	for i, img := range processed {
+		images[i] = img.ProductImage
+	}
+	if err := h.store.AddImages(productID, images); err != nil {
+		h.deleteBlobs(stored...)
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeImages(w, http.StatusCreated, productID)
+}
+
+// processImage reads one upload, checks its type and size from the content
+// and renders the thumbnail.
+func processImage(productID uuid.UUID, fh *multipart.FileHeader, maxBytes int64) (*processedImage, error) {
+	if fh.Size > maxBytes {
+		return nil, errImageTooLarge
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errImageTooLarge
+	}
+
+	contentType := mimetype.Detect(data).String()
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return nil, errUnsupportedImage
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	thumb, thumbType, err := makeThumbnail(decoded, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uuid.New()
+	base := fmt.Sprintf("products/%s/%s", productID, id)
+	return &processedImage{
+		ProductImage: types.ProductImage{
+			ID:           id,
+			ProductID:    productID,
+			ContentType:  contentType,
+			Width:        cfg.Width,
+			Height:       cfg.Height,
+			CreatedAt:    time.Now(),
+			Key:          base + ext,
+			ThumbnailKey: base + "_thumb" + imageExtensions[thumbType],
+		},
+		data:      data,
+		thumbnail: thumb,
+		thumbType: thumbType,
+	}, nil
+}
+
+// @Summary List product images
+// @Description List a product's images in display order
+// @Tags Products
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Success 200 {array} types.ProductImage
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /products/{productID}/images [get]
+
+func (h *Handler) handleListImages(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.productParam(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeImages(w, http.StatusOK, productID)
+}
+
+// @Summary Reorder product images
+// @Description Set the display order of a product's images. image_ids must list each of them once
+// @Tags Products
+// @Accept json
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Param order body types.ReorderImagesPayload true "Image IDs in display order"
+// @Success 200 {array} types.ProductImage
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/images/order [put]
+
+func (h *Handler) handleReorderImages(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.productParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input types.ReorderImagesPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.store.ReorderImages(productID, input.ImageIDs); err != nil {
+		utils.WriteError(w, imageStatus(err), err)
+		return
+	}
+
+	h.writeImages(w, http.StatusOK, productID)
+}
+
+// @Summary Set the primary product image
+// @Description Make an image the product's primary image, shown in listings
+// @Tags Products
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Param imageID path string true "Image UUID"
+// @Success 200 {array} types.ProductImage
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/images/{imageID}/primary [post]
+
+func (h *Handler) handleSetPrimaryImage(w http.ResponseWriter, r *http.Request) {
+	productID, imageID, ok := imageParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.SetPrimaryImage(productID, imageID); err != nil {
+		utils.WriteError(w, imageStatus(err), notFound(err, "image"))
+		return
+	}
+
+	h.writeImages(w, http.StatusOK, productID)
+}
+
+// @Summary Delete a product image
+// @Description Remove an image and its stored files. The next image takes over as primary
+// @Tags Products
+// @Param productID path string true "Product UUID"
+// @Param imageID path string true "Image UUID"
+// @Success 204 {object} nil
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/images/{imageID} [delete]
+
+func (h *Handler) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	productID, imageID, ok := imageParams(w, r)
+	if !ok {
+		return
+	}
+
+	img, err := h.store.DeleteImage(productID, imageID)
+	if err != nil {
+		utils.WriteError(w, imageStatus(err), notFound(err, "image"))
+		return
+	}
+	h.deleteBlobs(img.Key, img.ThumbnailKey)
+
+	if _, err := h.loadImages(productID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteNoContent(w)
+}
+
+// writeImages answers with the product's images after a change.
+func (h *Handler) writeImages(w http.ResponseWriter, status int, productID uuid.UUID) {
+	images, err := h.loadImages(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, status, images)
+}
+
+// loadImages lists a product's images with their URLs and keeps
+// Product.Image pointing at the primary one.
+func (h *Handler) loadImages(productID uuid.UUID) ([]types.ProductImage, error) {
+	images, err := h.store.ListImages(productID)
+	if err != nil {
+		return nil, err
+	}
+
+	primary := ""
+	for i := range images {
+		images[i].URL = h.blobs.URL(images[i].Key)
+		images[i].ThumbnailURL = h.blobs.URL(images[i].ThumbnailKey)
+		if images[i].IsPrimary {
+			primary = images[i].URL
+		}
+	}
+
+	if primary != "" || len(images) == 0 {
+		if err := h.store.SetProductImage(productID, primary); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// deleteBlobs removes stored files, logging failures; an orphaned file is
+// not worth failing a request over.
+func (h *Handler) deleteBlobs(keys ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, key := range keys {
+		if err := h.blobs.Delete(ctx, key); err != nil && !errors.Is(err, blob.ErrNotFound) {
+			log.Printf("deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+func imageParams(w http.ResponseWriter, r *http.Request) (productID, imageID uuid.UUID, ok bool) {
+	productID, err := uuid.Parse(chi.URLParam(r, "productID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product ID"))
+		return uuid.Nil, uuid.Nil, false
+	}
+	imageID, err = uuid.Parse(chi.URLParam(r, "imageID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid image ID"))
+		return uuid.Nil, uuid.Nil, false
+	}
+	return productID, imageID, true
+}
+
+// imageStatus maps image errors to an HTTP status.
+func imageStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnsupportedImage):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errImageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrImageSet):
+		return http.StatusBadRequest
+	default:
+		return variantStatus(err)
+	}
+}
@@ -1,36 +1,70 @@
 package product
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/kimenyu/executive/internal/blob"
+	"github.com/kimenyu/executive/services/auth"
 	"github.com/kimenyu/executive/types"
 	"github.com/kimenyu/executive/utils"
 )
 
 type Handler struct {
-	store types.ProductStore
+	store     types.ProductStore
+	userStore types.UserStore
+	blobs     blob.BlobStore
 }
 
-func NewHandler(store types.ProductStore) *Handler {
-	return &Handler{store: store}
+func NewHandler(store types.ProductStore, userStore types.UserStore, blobs blob.BlobStore) *Handler {
+	return &Handler{store: store, userStore: userStore, blobs: blobs}
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Route("/products", func(r chi.Router) {
-		r.Get("/all", h.handleGetProducts)
+		r.Get("/", h.handleListProducts)
+		// kept for older clients, same response as GET /products
+		r.Get("/all", h.handleListProducts)
+		r.Get("/search", h.handleSearchProducts)
 		r.Get("/{productID}", h.handleGetProduct)
-		r.Post("/create", h.handleCreateProduct)
-		r.Delete("/delete/{productID}", h.handleDeleteProduct)
-		r.Put("/update/{productID}", h.handleUpdateProduct)
+		r.Get("/{productID}/variants", h.handleListVariants)
+		r.Get("/{productID}/images", h.handleListImages)
+
+		// catalog writes are restricted to admin and staff
+		r.Group(func(r chi.Router) {
+			r.Use(auth.WithJWTAuth(h.userStore))
+			r.Use(auth.RequireRole(types.RoleAdmin, types.RoleStaff))
+
+			r.Post("/create", h.handleCreateProduct)
+			r.Post("/import", h.handleImportProducts)
+			r.Get("/export", h.handleExportProducts)
+			r.Delete("/delete/{productID}", h.handleDeleteProduct)
+			r.Get("/archived", h.handleListArchivedProducts)
+			r.Post("/{productID}/restore", h.handleRestoreProduct)
+			r.Put("/update/{productID}", h.handleUpdateProduct)
+
+			r.Post("/{productID}/variants", h.handleCreateVariant)
+			r.Put("/{productID}/variants/{variantID}", h.handleUpdateVariant)
+			r.Delete("/{productID}/variants/{variantID}", h.handleDeleteVariant)
+
+			r.Post("/{productID}/images", h.handleUploadImages)
+			r.Put("/{productID}/images/order", h.handleReorderImages)
+			r.Post("/{productID}/images/{imageID}/primary", h.handleSetPrimaryImage)
+			r.Delete("/{productID}/images/{imageID}", h.handleDeleteImage)
+		})
 	})
 }
 
 // @Summary Create a new product
-// @Description Add a new product to the catalog
+// @Description Add a new product to the catalog with a default variant holding its stock
 // @Tags Products
 // @Accept json
 // @Produce json
@@ -38,6 +72,7 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 // @Success 201 {object} types.Product
 // @Failure 400 {object} map[string]string
 // @Failure 500 {object} map[string]string
+// @Security BearerAuth
 // @Router /products/create [post]
 
 func (h *Handler) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
@@ -72,27 +107,41 @@ func (h *Handler) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
 		Quantity:    input.Quantity,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
+		Variants:    []types.ProductVariant{{SKU: input.SKU, Quantity: input.Quantity}},
 	}
 
 	if err := h.store.CreateProduct(product); err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, variantStatus(err), err)
 		return
 	}
 
 	utils.WriteJSON(w, http.StatusCreated, product)
 }
 
-// @Summary Get all products
-// @Description Retrieve a list of all products
+// @Summary List products
+// @Description Page through the catalog with optional filters and sorting
 // @Tags Products
 // @Produce json
-// @Success 200 {array} types.Product
+// @Param category query string false "Category UUID or slug, including subcategories"
+// @Param min_price query string false "Minimum price, e.g. 100.00"
+// @Param max_price query string false "Maximum price"
+// @Param in_stock query bool false "Only products with stock"
+// @Param sort query string false "newest (default), price_asc, price_desc, name or rating"
+// @Param page query int false "Page number, from 1"
+// @Param per_page query int false "Page size, at most 100"
+// @Success 200 {object} types.ProductList
+// @Failure 400 {object} map[string]string
 // @Failure 500 {object} map[string]string
-// @Router /products/all [get]
+// @Router /products [get]
 
-func (h *Handler) handleGetProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := h.store.GetAllProducts()
+func (h *Handler) handleListProducts(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
 
+	products, err := h.store.ListProducts(filter)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
@@ -101,8 +150,117 @@ func (h *Handler) handleGetProducts(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, http.StatusOK, products)
 }
 
+// @Summary Search products
+// @Description Full-text search over product names and descriptions, ranked by relevance. Every word matches as a prefix and highlights are wrapped in <mark> tags.
+// @Tags Products
+// @Produce json
+// @Param q query string true "Search text"
+// @Param category query string false "Category UUID or slug, including subcategories"
+// @Param min_price query string false "Minimum price, e.g. 100.00"
+// @Param max_price query string false "Maximum price"
+// @Param in_stock query bool false "Only products with stock"
+// @Param page query int false "Page number, from 1"
+// @Param per_page query int false "Page size, at most 100"
+// @Success 200 {object} types.ProductSearchList
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /products/search [get]
+
+func (h *Handler) handleSearchProducts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if strings.TrimSpace(q.Get("q")) == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("q is required"))
+		return
+	}
+
+	filter, err := parseProductFilter(q)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := h.store.SearchProducts(q.Get("q"), filter)
+	if errors.Is(err, ErrEmptyQuery) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, results)
+}
+
+// parseProductFilter reads the listing query parameters, rejecting
+// malformed values instead of ignoring them.
+func parseProductFilter(q url.Values) (types.ProductFilter, error) {
+	filter := types.ProductFilter{Sort: types.ProductSortNewest}
+
+	if v := q.Get("category"); v != "" {
+		if id, err := uuid.Parse(v); err == nil {
+			filter.CategoryID = &id
+		} else {
+			filter.CategorySlug = v
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **types.Money
+	}{{"min_price", &filter.MinPrice}, {"max_price", &filter.MaxPrice}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		price, err := types.ParseMoney(v)
+		if err != nil || price.Amount < 0 {
+			return filter, fmt.Errorf("invalid %s", p.name)
+		}
+		*p.dst = &price
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && filter.MinPrice.Amount > filter.MaxPrice.Amount {
+		return filter, fmt.Errorf("min_price is above max_price")
+	}
+
+	if v := q.Get("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid in_stock")
+		}
+		filter.InStock = inStock
+	}
+
+	if v := q.Get("sort"); v != "" {
+		switch v {
+		case types.ProductSortNewest, types.ProductSortPriceAsc, types.ProductSortPriceDesc,
+			types.ProductSortName, types.ProductSortRating:
+			filter.Sort = v
+		default:
+			return filter, fmt.Errorf("invalid sort %q", v)
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"page", &filter.Page}, {"per_page", &filter.PerPage}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return filter, fmt.Errorf("invalid %s", p.name)
+		}
+		*p.dst = n
+	}
+
+	return filter, nil
+}
+
 // @Summary Get product by ID
-// @Description Retrieve a single product by its UUID
+// @Description Retrieve a single product by its UUID. Archived products are returned with archived_at set
 // @Tags Products
 // @Produce json
 // @Param productID path string true "Product UUID"
@@ -120,16 +278,36 @@ func (h *Handler) handleGetProduct(w http.ResponseWriter, r *http.Request) {
 	}
 
 	product, err := h.store.GetProductByID(productUUID)
+	if err == sql.ErrNoRows {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("product not found"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	product.Variants, err = h.store.ListVariants(productUUID)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	product.Images, err = h.store.ListImages(productUUID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range product.Images {
+		product.Images[i].URL = h.blobs.URL(product.Images[i].Key)
+		product.Images[i].ThumbnailURL = h.blobs.URL(product.Images[i].ThumbnailKey)
+	}
+
 	utils.WriteJSON(w, http.StatusOK, product)
 }
 
 // @Summary Update an existing product
-// @Description Modify a product by its UUID
+// @Description Modify a product by its UUID. Quantity can only change for products with a single variant
 // @Tags Products
 // @Accept json
 // @Produce json
@@ -138,6 +316,7 @@ func (h *Handler) handleGetProduct(w http.ResponseWriter, r *http.Request) {
 // @Success 200 {object} types.Product
 // @Failure 400 {object} map[string]string
 // @Failure 500 {object} map[string]string
+// @Security BearerAuth
 // @Router /products/update/{productID} [put]
 
 func (h *Handler) handleUpdateProduct(w http.ResponseWriter, r *http.Request) {
@@ -184,20 +363,22 @@ func (h *Handler) handleUpdateProduct(w http.ResponseWriter, r *http.Request) {
 
 	// Update in DB
 	if err := h.store.UpdateProduct(product); err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, variantStatus(err), notFound(err, "product"))
 		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, product)
 }
 
-// @Summary Delete a product
-// @Description Remove a product by its UUID
+// @Summary Archive a product
+// @Description Hide a product from listings, search and carts. It stays available to order history and can be restored.
 // @Tags Products
 // @Param productID path string true "Product UUID"
 // @Success 204 {object} nil
 // @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
 // @Failure 500 {object} map[string]string
+// @Security BearerAuth
 // @Router /products/delete/{productID} [delete]
 
 func (h *Handler) handleDeleteProduct(w http.ResponseWriter, r *http.Request) {
@@ -210,11 +391,74 @@ func (h *Handler) handleDeleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.DeleteProduct(productUUID); err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
+	if err := h.store.ArchiveProduct(productUUID); err != nil {
+		utils.WriteError(w, variantStatus(err), notFound(err, "product"))
 		return
 	}
 
 	utils.WriteNoContent(w)
+}
 
+// @Summary Restore an archived product
+// @Description Return an archived product to the catalog
+// @Tags Products
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Success 200 {object} types.Product
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/restore [post]
+
+func (h *Handler) handleRestoreProduct(w http.ResponseWriter, r *http.Request) {
+	productUUID, err := uuid.Parse(chi.URLParam(r, "productID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product id: %w", err))
+		return
+	}
+
+	if err := h.store.RestoreProduct(productUUID); err != nil {
+		utils.WriteError(w, variantStatus(err), notFound(err, "product"))
+		return
+	}
+
+	product, err := h.store.GetProductByID(productUUID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, product)
+}
+
+// @Summary List archived products
+// @Description Page through archived products, with the same filters and sorting as the catalog listing
+// @Tags Products
+// @Produce json
+// @Param category query string false "Category UUID or slug, including subcategories"
+// @Param sort query string false "newest (default), price_asc, price_desc, name or rating"
+// @Param page query int false "Page number, from 1"
+// @Param per_page query int false "Page size, at most 100"
+// @Success 200 {object} types.ProductList
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/archived [get]
+
+func (h *Handler) handleListArchivedProducts(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter.Archived = true
+
+	products, err := h.store.ListProducts(filter)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, products)
 }
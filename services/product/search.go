@@ -0,0 +1,121 @@
+package product
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/kimenyu/executive/types"
+)
+
+var ErrEmptyQuery = errors.New("search query has no words")
+
+// headlineOptions mark matches for ts_headline. Descriptions are cut down
+// to a couple of fragments around the matches.
+const (
+	nameHeadline    = `StartSel=<mark>, StopSel=</mark>, HighlightAll=true`
+	snippetHeadline = `StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`
+)
+
+// prefixQuery turns free text into a tsquery where every word matches as a
+// prefix, so "wirel head" finds "wireless headphones". Anything that isn't
+// a letter or digit separates words, which also keeps tsquery operators
+// out of user input.
+func prefixQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = w + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// SearchProducts returns products matching q ranked by relevance, narrowed
+// by the listing filters. With pg_trgm installed, names within a typo or two
+// of the query match as well.
+func (s *Store) SearchProducts(q string, filter types.ProductFilter) (*types.ProductSearchList, error) {
+	tsquery := prefixQuery(q)
+	if tsquery == "" {
+		return nil, ErrEmptyQuery
+	}
+
+	page, perPage := pageBounds(filter)
+
+	// $1 is the tsquery, $2 the raw text for trigram matching
+	args := []any{tsquery}
+	match := "p.search_vector @@ sq.query"
+	rank := "ts_rank_cd(p.search_vector, sq.query)"
+	if s.fuzzy() {
+		args = append(args, strings.TrimSpace(q))
+		match = "(" + match + " OR $2::text <% p.name)"
+		rank += " + word_similarity($2::text, p.name)"
+	}
+
+	conds, args := productConds(filter, []string{match}, args)
+	where := whereClause(conds)
+	with := `WITH sq AS (SELECT to_tsquery('english', $1) AS query)`
+
+	var total int
+	err := s.db.QueryRow(with+` SELECT COUNT(*) FROM products p, sq`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`%s
+		SELECT %s, %s AS rank,
+			ts_headline('english', p.name, sq.query, '%s'),
+			ts_headline('english', COALESCE(p.description, ''), sq.query, '%s')
+		FROM %s, sq%s
+		ORDER BY rank DESC, p.id
+		LIMIT $%d OFFSET $%d`,
+		with, productColumns, rank, nameHeadline, snippetHeadline, productFrom, where, len(args)+1, len(args)+2)
+
+	rows, err := s.db.Query(query, append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*types.ProductSearchResult, 0, perPage)
+	for rows.Next() {
+		var res types.ProductSearchResult
+		res.Product, err = scanProduct(searchRow{rows, &res})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &types.ProductSearchList{
+		Results:    results,
+		Pagination: pagination(page, perPage, total),
+	}, nil
+}
+
+// searchRow lets scanProduct read a search row by appending the rank and
+// highlight columns to its destinations.
+type searchRow struct {
+	row interface{ Scan(...any) error }
+	res *types.ProductSearchResult
+}
+
+func (r searchRow) Scan(dest ...any) error {
+	return r.row.Scan(append(dest, &r.res.Rank, &r.res.NameHighlight, &r.res.Snippet)...)
+}
+
+// fuzzy reports whether pg_trgm is available for typo-tolerant matching.
+func (s *Store) fuzzy() bool {
+	s.trgmOnce.Do(func() {
+		err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')`).Scan(&s.trgm)
+		if err != nil {
+			log.Printf("checking for pg_trgm: %v", err)
+		}
+	})
+	return s.trgm
+}
@@ -1,15 +1,27 @@
 package product
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/kimenyu/executive/helpers"
 	"github.com/kimenyu/executive/types"
+	"github.com/lib/pq"
 )
 
 type Store struct {
 	db *sql.DB
+
+	// whether pg_trgm is installed, checked on the first search
+	trgmOnce sync.Once
+	trgm     bool
 }
 
 // constructor
@@ -17,62 +29,918 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
-// create a product
+var (
+	ErrDuplicateSKU     = errors.New("SKU already in use")
+	ErrDuplicateOptions = errors.New("product already has a variant with these options")
+	ErrLastVariant      = errors.New("a product needs at least one variant")
+	ErrVariantStock     = errors.New("product has several variants, set stock on each variant")
+)
+
+// create a product along with product.Variants, or a default variant
+// holding product.Quantity when there are none
 func (s *Store) CreateProduct(product *types.Product) error {
-	_, err := s.db.Exec(`INSERT INTO products(id, name, description, price, image, category_id, quantity, created_at, updated_at)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO products(id, name, description, price, image, category_id, quantity, created_at, updated_at)
 VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`, product.ID, product.Name, product.Description, product.Price, product.Image, product.CategoryID, product.Quantity, product.CreatedAt, product.UpdatedAt)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if len(product.Variants) == 0 {
+		product.Variants = []types.ProductVariant{{Quantity: product.Quantity}}
+	}
+
+	product.Quantity = 0
+	for i := range product.Variants {
+		v := &product.Variants[i]
+		if v.ID == uuid.Nil {
+			v.ID = uuid.New()
+		}
+		if v.SKU == "" {
+			// the default variant keeps the migration's scheme; further
+			// variants need SKUs of their own
+			v.SKU = DefaultSKU(product.ID)
+			if len(product.Variants) > 1 {
+				v.SKU = DefaultSKU(v.ID)
+			}
+		}
+		v.ProductID = product.ID
+		v.CreatedAt, v.UpdatedAt = product.CreatedAt, product.UpdatedAt
+		if err := insertVariant(ctx, tx, v); err != nil {
+			return err
+		}
+		v.Price = product.Price
+		if v.PriceOverride != nil {
+			v.Price = *v.PriceOverride
+		}
+		product.Quantity += v.Quantity
+	}
+
+	return tx.Commit()
 }
 
-// get all products
-func (s *Store) GetAllProducts() ([]*types.Product, error) {
-	rows, err := s.db.Query("SELECT * FROM products")
-	if err != nil {
+// DefaultSKU is the SKU given to a variant when none is supplied, derived
+// from the product's ID for a lone default variant and from the variant's
+// own ID otherwise. The migration that introduced variants used the same
+// scheme.
+func DefaultSKU(id uuid.UUID) string {
+	return "SKU-" + strings.ToUpper(strings.ReplaceAll(id.String(), "-", "")[:12])
+}
+
+// productColumns are read by scanProduct. Listing explicit columns keeps
+// scans working when the table grows.
+const productColumns = `p.id, p.name, COALESCE(p.description, ''), p.price, COALESCE(p.image, ''), p.category_id,
+	COALESCE(p.quantity, 0), p.created_at, p.updated_at, p.archived_at, COALESCE(r.rating, 0), COALESCE(r.reviews, 0)`
+
+// productFrom joins each product's review aggregate.
+const productFrom = `products p
+	LEFT JOIN (
+		SELECT product_id, ROUND(AVG(rating), 2)::float8 AS rating, COUNT(*) AS reviews
+		FROM reviews GROUP BY product_id
+	) r ON r.product_id = p.id`
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// productOrder maps a sort to its ORDER BY. The id tiebreak keeps pages
+// stable when values repeat.
+var productOrder = map[string]string{
+	types.ProductSortNewest:    "p.created_at DESC, p.id",
+	types.ProductSortPriceAsc:  "p.price ASC, p.id",
+	types.ProductSortPriceDesc: "p.price DESC, p.id",
+	types.ProductSortName:      "lower(p.name) ASC, p.id",
+	types.ProductSortRating:    "COALESCE(r.rating, 0) DESC, COALESCE(r.reviews, 0) DESC, p.id",
+}
+
+// ListProducts returns one page of products matching filter along with the
+// pagination metadata.
+func (s *Store) ListProducts(filter types.ProductFilter) (*types.ProductList, error) {
+	order, ok := productOrder[filter.Sort]
+	if !ok {
+		order = productOrder[types.ProductSortNewest]
+	}
+
+	page, perPage := pageBounds(filter)
+	conds, args := productConds(filter, nil, nil)
+	where := whereClause(conds)
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM products p`+where, args...).Scan(&total); err != nil {
 		return nil, err
 	}
 
+	query := fmt.Sprintf(`SELECT %s FROM %s%s ORDER BY %s LIMIT $%d OFFSET $%d`,
+		productColumns, productFrom, where, order, len(args)+1, len(args)+2)
+	rows, err := s.db.Query(query, append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	products := make([]*types.Product, 0)
-
+	products := make([]*types.Product, 0, perPage)
 	for rows.Next() {
-		p, err := helpers.ScanRowsIntoProducts(rows)
+		p, err := scanProduct(rows)
 		if err != nil {
 			return nil, err
 		}
 		products = append(products, p)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &types.ProductList{
+		Products:   products,
+		Pagination: pagination(page, perPage, total),
+	}, nil
+}
 
-	return products, nil
+func pageBounds(filter types.ProductFilter) (page, perPage int) {
+	page, perPage = filter.Page, filter.PerPage
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	return page, min(perPage, maxPerPage)
+}
+
+func pagination(page, perPage, total int) types.Pagination {
+	return types.Pagination{
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: (total + perPage - 1) / perPage,
+	}
+}
+
+// productConds appends the conditions of filter to conds, numbering its
+// placeholders after the ones already in args.
+func productConds(filter types.ProductFilter, conds []string, args []any) ([]string, []any) {
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.Archived {
+		conds = append(conds, "p.archived_at IS NOT NULL")
+	} else {
+		conds = append(conds, "p.archived_at IS NULL")
+	}
+	if filter.CategoryID != nil {
+		add("p.category_id IN ("+categorySubtree("id = $%d")+")", *filter.CategoryID)
+	} else if filter.CategorySlug != "" {
+		add("p.category_id IN ("+categorySubtree("slug = $%d")+")", filter.CategorySlug)
+	}
+	if filter.MinPrice != nil {
+		add("p.price >= $%d", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		add("p.price <= $%d", *filter.MaxPrice)
+	}
+	if filter.InStock {
+		conds = append(conds, "p.quantity > 0")
+	}
+	return conds, args
+}
+
+// categorySubtree selects the ids of the categories matching root and of all
+// their descendants.
+func categorySubtree(root string) string {
+	return `WITH RECURSIVE sub AS (
+	SELECT id FROM categories WHERE ` + root + `
+	UNION ALL
+	SELECT c.id FROM categories c JOIN sub ON c.parent_id = sub.id
+) SELECT id FROM sub`
+}
+
+// whereClause joins conds into a WHERE clause, empty without conditions.
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
 }
 
 // get product by id
 func (s *Store) GetProductByID(id uuid.UUID) (*types.Product, error) {
-	row := s.db.QueryRow("SELECT * FROM products WHERE id=$1", id)
-	return helpers.ScanRowIntoProduct(row)
+	row := s.db.QueryRow(`SELECT `+productColumns+` FROM `+productFrom+` WHERE p.id = $1`, id)
+	return scanProduct(row)
 }
 
-// update a product
+// update a product. Stock belongs to variants, so a changed quantity is
+// only accepted for products with a single variant, which takes it.
 func (s *Store) UpdateProduct(product *types.Product) error {
-	_, err := s.db.Exec(`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
 		UPDATE products 
 		SET name = $1, 
 		    description = $2, 
 		    price = $3, 
 		    image = $4, 
 		    category_id = $5, 
-		    quantity = $6, 
-		    updated_at = $7
-		WHERE id = $8
+		    updated_at = $6
+		WHERE id = $7
 	`, product.Name, product.Description, product.Price, product.Image,
-		product.CategoryID, product.Quantity, product.UpdatedAt, product.ID)
+		product.CategoryID, product.UpdatedAt, product.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, quantity FROM product_variants WHERE product_id = $1 FOR UPDATE`, product.ID)
+	if err != nil {
+		return err
+	}
+	var variantID uuid.UUID
+	variants, total := 0, 0
+	for rows.Next() {
+		var quantity int
+		if err := rows.Scan(&variantID, &quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		variants++
+		total += quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if total != product.Quantity {
+		if variants != 1 {
+			return ErrVariantStock
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE product_variants SET quantity = $1, updated_at = $2 WHERE id = $3`,
+			product.Quantity, product.UpdatedAt, variantID)
+		if err != nil {
+			return variantError(err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ArchiveProduct hides a product from listings, search and carts. Its
+// rows stay so orders, reviews and images keep their product; archiving
+// twice keeps the first timestamp.
+func (s *Store) ArchiveProduct(id uuid.UUID) error {
+	res, err := s.db.Exec(`UPDATE products SET archived_at = COALESCE(archived_at, CURRENT_TIMESTAMP) WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+// RestoreProduct returns an archived product to the catalog.
+func (s *Store) RestoreProduct(id uuid.UUID) error {
+	res, err := s.db.Exec(`UPDATE products SET archived_at = NULL WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+// expectOneRow turns an update that matched nothing into sql.ErrNoRows.
+func expectOneRow(res sql.Result) error {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// scanProduct reads productColumns from a *sql.Row or *sql.Rows.
+func scanProduct(row interface{ Scan(...any) error }) (*types.Product, error) {
+	var p types.Product
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Image, &p.CategoryID,
+		&p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.ArchivedAt, &p.Rating, &p.ReviewCount)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+const variantColumns = `v.id, v.product_id, v.sku, v.options, v.price, COALESCE(v.price, p.price), v.quantity, v.created_at, v.updated_at`
+
+func (s *Store) CreateVariant(variant *types.ProductVariant) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertVariant(ctx, tx, variant); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE($1::numeric, price) FROM products WHERE id = $2`,
+		variant.PriceOverride, variant.ProductID).Scan(&variant.Price)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertVariant(ctx context.Context, tx *sql.Tx, v *types.ProductVariant) error {
+	options, err := json.Marshal(variantOptions(v.Options))
+	if err != nil {
+		return err
+	}
 
+	_, err = tx.ExecContext(ctx, `INSERT INTO product_variants (id, product_id, sku, options, price, quantity, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		v.ID, v.ProductID, v.SKU, options, v.PriceOverride, v.Quantity, v.CreatedAt, v.UpdatedAt)
+	return variantError(err)
+}
+
+func (s *Store) GetVariant(id uuid.UUID) (*types.ProductVariant, error) {
+	row := s.db.QueryRow(`SELECT `+variantColumns+`
+		FROM product_variants v JOIN products p ON p.id = v.product_id
+		WHERE v.id = $1`, id)
+	return scanVariant(row)
+}
+
+func (s *Store) ListVariants(productID uuid.UUID) ([]types.ProductVariant, error) {
+	rows, err := s.db.Query(`SELECT `+variantColumns+`
+		FROM product_variants v JOIN products p ON p.id = v.product_id
+		WHERE v.product_id = $1
+		ORDER BY v.created_at, v.sku`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []types.ProductVariant{}
+	for rows.Next() {
+		v, err := scanVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, *v)
+	}
+	return variants, rows.Err()
+}
+
+// UpdateVariant replaces the SKU, options, price override and stock of a
+// variant of variant.ProductID.
+func (s *Store) UpdateVariant(variant *types.ProductVariant) error {
+	options, err := json.Marshal(variantOptions(variant.Options))
+	if err != nil {
+		return err
+	}
+
+	row := s.db.QueryRow(`UPDATE product_variants v
+		SET sku = $1, options = $2, price = $3, quantity = $4, updated_at = $5
+		FROM products p
+		WHERE v.id = $6 AND v.product_id = $7 AND p.id = v.product_id
+		RETURNING `+variantColumns,
+		variant.SKU, options, variant.PriceOverride, variant.Quantity, variant.UpdatedAt, variant.ID, variant.ProductID)
+
+	updated, err := scanVariant(row)
+	if err != nil {
+		return variantError(err)
+	}
+	*variant = *updated
+	return nil
+}
+
+// DeleteVariant removes a variant of productID unless it is the last one.
+// Cart lines for it go with it; order lines keep their SKU.
+func (s *Store) DeleteVariant(productID, variantID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the product so two deletes can't remove the last two variants
+	var variants int
+	err = tx.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM product_variants WHERE product_id = p.id)
+		FROM products p WHERE p.id = $1 FOR UPDATE`, productID).Scan(&variants)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM product_variants WHERE id = $1 AND product_id = $2`, variantID, productID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	if variants <= 1 {
+		return ErrLastVariant
+	}
+
+	return tx.Commit()
+}
+
+// scanVariant reads variantColumns from a *sql.Row or *sql.Rows.
+func scanVariant(row interface{ Scan(...any) error }) (*types.ProductVariant, error) {
+	var v types.ProductVariant
+	var options []byte
+	err := row.Scan(&v.ID, &v.ProductID, &v.SKU, &options, &v.PriceOverride, &v.Price, &v.Quantity, &v.CreatedAt, &v.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(options, &v.Options); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func variantOptions(options map[string]string) map[string]string {
+	if options == nil {
+		return map[string]string{}
+	}
+	return options
+}
+
+// variantError turns unique violations on variants into their sentinel
+// errors.
+func variantError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "product_variants_sku_key":
+		return ErrDuplicateSKU
+	case "product_variants_product_id_options_key":
+		return ErrDuplicateOptions
+	}
 	return err
 }
 
-// delete product
-func (s *Store) DeleteProduct(id uuid.UUID) error {
-	_, err := s.db.Exec("DELETE FROM products WHERE id=$1", id)
+var ErrImageSet = errors.New("image_ids must list every image of the product exactly once")
+
+const imageColumns = `id, product_id, object_key, thumbnail_key, content_type, width, height, position, is_primary, created_at`
+
+func (s *Store) AddImages(productID uuid.UUID, images []types.ProductImage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the product lock serialises uploads so positions don't collide
+	var next int
+	var hasPrimary bool
+	err = tx.QueryRowContext(ctx, `SELECT
+			(SELECT COALESCE(MAX(position), -1) + 1 FROM product_images WHERE product_id = p.id),
+			EXISTS (SELECT 1 FROM product_images WHERE product_id = p.id AND is_primary)
+		FROM products p WHERE p.id = $1 FOR UPDATE`, productID).Scan(&next, &hasPrimary)
+	if err != nil {
+		return err
+	}
+
+	newPrimary := slices.IndexFunc(images, func(img types.ProductImage) bool { return img.IsPrimary })
+	if newPrimary < 0 && !hasPrimary && len(images) > 0 {
+		newPrimary = 0
+	}
+	if newPrimary >= 0 && hasPrimary {
+		if _, err := tx.ExecContext(ctx, `UPDATE product_images SET is_primary = false WHERE product_id = $1 AND is_primary`, productID); err != nil {
+			return err
+		}
+	}
+
+	for i := range images {
+		img := &images[i]
+		img.ProductID = productID
+		img.Position = next + i
+		img.IsPrimary = i == newPrimary
+
+		_, err := tx.ExecContext(ctx, `INSERT INTO product_images (`+imageColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			img.ID, img.ProductID, img.Key, img.ThumbnailKey, img.ContentType, img.Width, img.Height, img.Position, img.IsPrimary, img.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) ListImages(productID uuid.UUID) ([]types.ProductImage, error) {
+	rows, err := s.db.Query(`SELECT `+imageColumns+` FROM product_images WHERE product_id = $1 ORDER BY position, id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []types.ProductImage{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, *img)
+	}
+	return images, rows.Err()
+}
+
+func (s *Store) SetPrimaryImage(productID, imageID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE product_images SET is_primary = false WHERE product_id = $1 AND is_primary`, productID); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE product_images SET is_primary = true WHERE id = $1 AND product_id = $2`, imageID, productID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// ReorderImages sets the display order of a product's images. imageIDs has
+// to name every image of the product once.
+func (s *Store) ReorderImages(productID uuid.UUID, imageIDs []uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM product_images WHERE product_id = $1 FOR UPDATE`, productID)
+	if err != nil {
+		return err
+	}
+	current := map[uuid.UUID]bool{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		current[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(imageIDs) != len(current) {
+		return ErrImageSet
+	}
+	for i, id := range imageIDs {
+		if !current[id] {
+			return ErrImageSet
+		}
+		delete(current, id)
+
+		if _, err := tx.ExecContext(ctx, `UPDATE product_images SET position = $1 WHERE id = $2`, i, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteImage removes an image of productID. When it was the primary one,
+// the next image in order takes over.
+func (s *Store) DeleteImage(productID, imageID uuid.UUID) (*types.ProductImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	img, err := scanImage(tx.QueryRowContext(ctx, `DELETE FROM product_images WHERE id = $1 AND product_id = $2
+		RETURNING `+imageColumns, imageID, productID))
+	if err != nil {
+		return nil, err
+	}
+
+	if img.IsPrimary {
+		_, err = tx.ExecContext(ctx, `UPDATE product_images SET is_primary = true
+			WHERE id = (SELECT id FROM product_images WHERE product_id = $1 ORDER BY position, id LIMIT 1)`, productID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// SetProductImage stores the URL older clients read from Product.Image.
+func (s *Store) SetProductImage(productID uuid.UUID, url string) error {
+	_, err := s.db.Exec(`UPDATE products SET image = $1 WHERE id = $2`, url, productID)
 	return err
 }
+
+// scanImage reads imageColumns from a *sql.Row or *sql.Rows.
+func scanImage(row interface{ Scan(...any) error }) (*types.ProductImage, error) {
+	var img types.ProductImage
+	err := row.Scan(&img.ID, &img.ProductID, &img.Key, &img.ThumbnailKey, &img.ContentType,
+		&img.Width, &img.Height, &img.Position, &img.IsPrimary, &img.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+var (
+	ErrUnknownCategory   = errors.New("unknown category")
+	ErrAmbiguousCategory = errors.New("category name matches several categories, use its slug")
+	ErrSKUOtherProduct   = errors.New("SKU belongs to another product")
+)
+
+// importTimeout bounds a whole import or export, which run as one query
+// or transaction.
+const importTimeout = 5 * time.Minute
+
+// ImportProducts upserts rows by SKU. Each row runs in its own savepoint so
+// a failing row is reported and skipped without aborting the others; on a
+// dry run the transaction is rolled back once every row has been tried.
+func (s *Store) ImportProducts(rows []types.CatalogRow, dryRun bool) (*types.ImportReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	categories, err := loadCategoryIndex(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// new variants without a product_id join the product of an earlier row
+	// with the same name
+	products := map[string]uuid.UUID{}
+
+	report := &types.ImportReport{DryRun: dryRun, Rows: len(rows), Errors: []types.ImportRowError{}}
+	for i := range rows {
+		row := &rows[i]
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT import_row`); err != nil {
+			return nil, err
+		}
+
+		created, productID, err := importRow(ctx, tx, row, categories, products)
+		if err != nil {
+			if _, rbErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT import_row`); rbErr != nil {
+				return nil, rbErr
+			}
+			report.Failed++
+			report.Errors = append(report.Errors, types.ImportRowError{Line: row.Line, SKU: row.SKU, Error: err.Error()})
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT import_row`); err != nil {
+			return nil, err
+		}
+		if _, ok := products[productKey(row.Name)]; !ok {
+			products[productKey(row.Name)] = productID
+		}
+		if created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+// productKey is what rows without a product_id are grouped by.
+func productKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// importRow upserts the variant of row.SKU and its product, reporting
+// whether the variant is new and which product it belongs to. A new SKU
+// without a product_id goes to the product products has for its name, or
+// to a new one.
+func importRow(ctx context.Context, tx *sql.Tx, row *types.CatalogRow, categories categoryIndex, products map[string]uuid.UUID) (bool, uuid.UUID, error) {
+	categoryID, err := categories.resolve(row.Category)
+	if err != nil {
+		return false, uuid.Nil, err
+	}
+
+	now := time.Now()
+	var variantID, productID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT id, product_id FROM product_variants WHERE sku = $1 FOR UPDATE`,
+		row.SKU).Scan(&variantID, &productID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		var ok bool
+		productID, ok = row.ProductID.UUID, row.ProductID.Valid
+		if !ok {
+			productID, ok = products[productKey(row.Name)]
+		}
+		if !ok {
+			productID = uuid.New()
+		}
+	case err != nil:
+		return false, uuid.Nil, err
+	case row.ProductID.Valid && row.ProductID.UUID != productID:
+		return false, uuid.Nil, ErrSKUOtherProduct
+	}
+
+	// empty optional columns keep what is stored
+	res, err := tx.ExecContext(ctx, `UPDATE products
+		SET name = $1, description = COALESCE(NULLIF($2, ''), description), price = $3,
+		    category_id = COALESCE($4, category_id), image = COALESCE(NULLIF($5, ''), image), updated_at = $6
+		WHERE id = $7`,
+		row.Name, row.Description, row.Price, categoryID, row.Image, now, productID)
+	if err != nil {
+		return false, uuid.Nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, uuid.Nil, err
+	} else if n == 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO products(id, name, description, price, image, category_id, quantity, created_at, updated_at)
+			VALUES($1, $2, $3, $4, $5, $6, 0, $7, $7)`,
+			productID, row.Name, row.Description, row.Price, row.Image, categoryID, now)
+		if err != nil {
+			return false, uuid.Nil, err
+		}
+	}
+
+	if variantID == uuid.Nil {
+		var quantity int
+		if row.Quantity != nil {
+			quantity = *row.Quantity
+		}
+		return true, productID, insertVariant(ctx, tx, &types.ProductVariant{
+			ID:            uuid.New(),
+			ProductID:     productID,
+			SKU:           row.SKU,
+			Options:       row.Options,
+			PriceOverride: row.PriceOverride,
+			Quantity:      quantity,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+	}
+
+	// options, price override and stock are only replaced when the row
+	// has them
+	var options any
+	if len(row.Options) > 0 {
+		b, err := json.Marshal(row.Options)
+		if err != nil {
+			return false, uuid.Nil, err
+		}
+		options = b
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE product_variants
+		SET options = COALESCE($1::jsonb, options), price = COALESCE($2, price), quantity = COALESCE($3, quantity), updated_at = $4
+		WHERE id = $5`,
+		options, row.PriceOverride, row.Quantity, now, variantID)
+	return false, productID, variantError(err)
+}
+
+// categoryIndex resolves the category column of an import: a slug, or a
+// name when it names a single category.
+type categoryIndex struct {
+	bySlug map[string]uuid.UUID
+	byName map[string][]uuid.UUID
+}
+
+func loadCategoryIndex(ctx context.Context, tx *sql.Tx) (categoryIndex, error) {
+	idx := categoryIndex{bySlug: map[string]uuid.UUID{}, byName: map[string][]uuid.UUID{}}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, name, slug FROM categories`)
+	if err != nil {
+		return idx, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		var name, slug string
+		if err := rows.Scan(&id, &name, &slug); err != nil {
+			return idx, err
+		}
+		idx.bySlug[slug] = id
+		key := strings.ToLower(strings.TrimSpace(name))
+		idx.byName[key] = append(idx.byName[key], id)
+	}
+	return idx, rows.Err()
+}
+
+func (idx categoryIndex) resolve(category string) (uuid.NullUUID, error) {
+	category = strings.TrimSpace(category)
+	if category == "" {
+		return uuid.NullUUID{}, nil
+	}
+	if id, ok := idx.bySlug[category]; ok {
+		return uuid.NullUUID{UUID: id, Valid: true}, nil
+	}
+	switch ids := idx.byName[strings.ToLower(category)]; len(ids) {
+	case 0:
+		return uuid.NullUUID{}, fmt.Errorf("%w %q", ErrUnknownCategory, category)
+	case 1:
+		return uuid.NullUUID{UUID: ids[0], Valid: true}, nil
+	default:
+		return uuid.NullUUID{}, fmt.Errorf("%w: %q", ErrAmbiguousCategory, category)
+	}
+}
+
+// ExportProducts streams every variant of the live catalog with its product
+// fields, products in creation order.
+func (s *Store) ExportProducts(fn func(types.CatalogRow) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT p.id, v.sku, p.name, COALESCE(p.description, ''), p.price, v.price,
+		       COALESCE(c.slug, ''), v.options, v.quantity, COALESCE(p.image, '')
+		FROM product_variants v
+		JOIN products p ON p.id = v.product_id
+		LEFT JOIN categories c ON c.id = p.category_id
+		WHERE p.archived_at IS NULL
+		ORDER BY p.created_at, p.id, v.created_at, v.sku`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row types.CatalogRow
+		var options []byte
+		err := rows.Scan(&row.ProductID, &row.SKU, &row.Name, &row.Description, &row.Price, &row.PriceOverride,
+			&row.Category, &options, &row.Quantity, &row.Image)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(options, &row.Options); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,259 @@
+package product
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/types"
+	"github.com/kimenyu/executive/utils"
+)
+
+// @Summary List product variants
+// @Description List the variants of a product with their SKU, options, effective price and stock
+// @Tags Products
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Success 200 {array} types.ProductVariant
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /products/{productID}/variants [get]
+
+func (h *Handler) handleListVariants(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.productParam(w, r)
+	if !ok {
+		return
+	}
+
+	variants, err := h.store.ListVariants(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, variants)
+}
+
+// @Summary Create a product variant
+// @Description Add a variant, e.g. a size and color, with its own SKU and stock. The price override is optional
+// @Tags Products
+// @Accept json
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Param variant body types.VariantPayload true "Variant to create"
+// @Success 201 {object} types.ProductVariant
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/variants [post]
+
+func (h *Handler) handleCreateVariant(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.productParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input types.VariantPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	variant := &types.ProductVariant{
+		ID:            uuid.New(),
+		ProductID:     productID,
+		SKU:           input.SKU,
+		Options:       input.Options,
+		PriceOverride: input.PriceOverride,
+		Quantity:      input.Quantity,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	if err := h.store.CreateVariant(variant); err != nil {
+		utils.WriteError(w, variantStatus(err), err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, variant)
+}
+
+// @Summary Update a product variant
+// @Description Replace the SKU, options, price override and stock of a variant
+// @Tags Products
+// @Accept json
+// @Produce json
+// @Param productID path string true "Product UUID"
+// @Param variantID path string true "Variant UUID"
+// @Param variant body types.VariantPayload true "Updated variant"
+// @Success 200 {object} types.ProductVariant
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/variants/{variantID} [put]
+
+func (h *Handler) handleUpdateVariant(w http.ResponseWriter, r *http.Request) {
+	productID, variantID, ok := variantParams(w, r)
+	if !ok {
+		return
+	}
+
+	var input types.VariantPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	variant := &types.ProductVariant{
+		ID:            variantID,
+		ProductID:     productID,
+		SKU:           input.SKU,
+		Options:       input.Options,
+		PriceOverride: input.PriceOverride,
+		Quantity:      input.Quantity,
+		UpdatedAt:     time.Now(),
+	}
+
+	if err := h.store.UpdateVariant(variant); err != nil {
+		utils.WriteError(w, variantStatus(err), notFound(err, "variant"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, variant)
+}
+
+// @Summary Delete a product variant
+// @Description Remove a variant. The last variant of a product can't be deleted; order history keeps the SKU
+// @Tags Products
+// @Param productID path string true "Product UUID"
+// @Param variantID path string true "Variant UUID"
+// @Success 204 {object} nil
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /products/{productID}/variants/{variantID} [delete]
+
+func (h *Handler) handleDeleteVariant(w http.ResponseWriter, r *http.Request) {
+	productID, variantID, ok := variantParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.DeleteVariant(productID, variantID); err != nil {
+		utils.WriteError(w, variantStatus(err), notFound(err, "variant"))
+		return
+	}
+
+	utils.WriteNoContent(w)
+}
+
+var ErrVariantRequired = errors.New("product has several variants, choose one")
+
+// ResolveVariant returns the variant of productID a cart or order line is
+// for. variantID may be left out for products with a single variant. A
+// variant of another product and archived products read as sql.ErrNoRows.
+func ResolveVariant(store types.ProductStore, productID uuid.UUID, variantID uuid.NullUUID) (*types.ProductVariant, error) {
+	product, err := store.GetProductByID(productID)
+	if err != nil {
+		return nil, err
+	}
+	if product.ArchivedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	if variantID.Valid {
+		v, err := store.GetVariant(variantID.UUID)
+		if err != nil {
+			return nil, err
+		}
+		if v.ProductID != productID {
+			return nil, sql.ErrNoRows
+		}
+		return v, nil
+	}
+
+	variants, err := store.ListVariants(productID)
+	if err != nil {
+		return nil, err
+	}
+	switch len(variants) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return &variants[0], nil
+	default:
+		return nil, ErrVariantRequired
+	}
+}
+
+// productParam parses the product ID from the URL and checks the product
+// exists.
+func (h *Handler) productParam(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	productID, err := uuid.Parse(chi.URLParam(r, "productID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product ID"))
+		return uuid.Nil, false
+	}
+
+	if _, err := h.store.GetProductByID(productID); err != nil {
+		utils.WriteError(w, variantStatus(err), notFound(err, "product"))
+		return uuid.Nil, false
+	}
+	return productID, true
+}
+
+func variantParams(w http.ResponseWriter, r *http.Request) (productID, variantID uuid.UUID, ok bool) {
+	productID, err := uuid.Parse(chi.URLParam(r, "productID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product ID"))
+		return uuid.Nil, uuid.Nil, false
+	}
+	variantID, err = uuid.Parse(chi.URLParam(r, "variantID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid variant ID"))
+		return uuid.Nil, uuid.Nil, false
+	}
+	return productID, variantID, true
+}
+
+// notFound replaces sql.ErrNoRows with a readable message.
+func notFound(err error, what string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s not found", what)
+	}
+	return err
+}
+
+// variantStatus maps product and variant store errors to an HTTP status.
+func variantStatus(err error) int {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateSKU), errors.Is(err, ErrDuplicateOptions),
+		errors.Is(err, ErrLastVariant), errors.Is(err, ErrVariantStock):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
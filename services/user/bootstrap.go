@@ -0,0 +1,72 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kimenyu/executive/services/auth"
+	"github.com/kimenyu/executive/types"
+)
+
+// BootstrapAdmin makes sure the account with the given email is an admin
+// with a verified email. An existing user is promoted; otherwise a new
+// admin is created, which requires a password. It is safe to run on every
+// startup.
+func BootstrapAdmin(store types.UserStore, name, email, password string) error {
+	u, err := store.GetUserByEmail(email)
+	if err == nil {
+		if u.EmailVerifiedAt == nil {
+			if err := store.MarkEmailVerified(u.ID); err != nil {
+				return err
+			}
+		}
+		if u.Role == types.RoleAdmin {
+			return nil
+		}
+
+		if err := store.UpdateUserRole(u.ID, types.RoleAdmin); err != nil {
+			return err
+		}
+		log.Printf("promoted %s to admin", email)
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("looking up admin %s: %w", email, err)
+	}
+
+	if password == "" {
+		return fmt.Errorf("user %s does not exist and no admin password was given", email)
+	}
+
+	hashedPassword, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		name = "Administrator"
+	}
+
+	admin := &types.User{
+		ID:        uuid.New(),
+		Name:      name,
+		Email:     email,
+		Password:  hashedPassword,
+		Role:      types.RoleAdmin,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := store.CreateUser(admin); err != nil {
+		return err
+	}
+	if err := store.MarkEmailVerified(admin.ID); err != nil {
+		return err
+	}
+
+	log.Printf("created admin user %s", email)
+	return nil
+}
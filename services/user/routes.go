@@ -1,7 +1,11 @@
 package user
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -9,25 +13,47 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/kimenyu/executive/configs"
+	"github.com/kimenyu/executive/internal/mail"
 	"github.com/kimenyu/executive/services/auth"
 	"github.com/kimenyu/executive/types"
 	"github.com/kimenyu/executive/utils"
 )
 
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
 type Handler struct {
-	store types.UserStore
+	store  types.UserStore
+	mailer mail.Mailer
 }
 
-func NewHandler(store types.UserStore) *Handler {
-	return &Handler{store: store}
+func NewHandler(store types.UserStore, mailer mail.Mailer) *Handler {
+	return &Handler{store: store, mailer: mailer}
 }
 
 func (h *Handler) RegisterRoutes(router chi.Router) {
 	router.Post("/login", h.handleLogin)
 	router.Post("/register", h.handleRegister)
+	router.Post("/token/refresh", h.handleRefreshToken)
+	router.Post("/password/forgot", h.handleForgotPassword)
+	router.Post("/password/reset", h.handleResetPassword)
+	router.Post("/email/verify", h.handleVerifyEmail)
+
+	// Secure routes
+	router.Group(func(r chi.Router) {
+		r.Use(auth.WithJWTAuth(h.store))
+
+		r.Get("/users/{userID}", h.handleGetUser)
+		r.Post("/logout", h.handleLogout)
+		r.Post("/logout/all", h.handleLogoutAll)
+		r.Post("/email/verify/resend", h.handleResendVerification)
+	})
 
-	// Secure route
-	router.With(auth.WithJWTAuth(h.store)).Get("/users/{userID}", h.handleGetUser)
+	// Admin only
+	router.With(auth.WithJWTAuth(h.store), auth.RequireRole(types.RoleAdmin)).
+		Patch("/users/{userID}/role", h.handleUpdateUserRole)
 }
 
 // @Summary Login a user
@@ -36,7 +62,7 @@ func (h *Handler) RegisterRoutes(router chi.Router) {
 // @Accept json
 // @Produce json
 // @Param credentials body types.LoginUserPayload true "Login payload"
-// @Success 200 {object} map[string]string
+// @Success 200 {object} types.AuthTokensResponse
 // @Failure 400 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /login [post]
@@ -65,14 +91,152 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tokens, err := h.startSession(u, r)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// startSession opens a new session for u and issues its first token pair.
+func (h *Handler) startSession(u *types.User, r *http.Request) (*types.AuthTokensResponse, error) {
+	refreshToken, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &types.Session{
+		ID:        uuid.New(),
+		UserID:    u.ID,
+		UserAgent: r.UserAgent(),
+		IP:        r.RemoteAddr,
+		ExpiresAt: now.Add(time.Second * time.Duration(configs.Envs.RefreshTokenExpirationInSeconds)),
+		CreatedAt: now,
+	}
+
+	err = h.store.CreateSession(session, &types.RefreshToken{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		TokenHash: auth.HashToken(refreshToken),
+		ExpiresAt: session.ExpiresAt,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return issueTokens(u, session.ID, refreshToken)
+}
+
+func issueTokens(u *types.User, sessionID uuid.UUID, refreshToken string) (*types.AuthTokensResponse, error) {
 	secret := []byte(configs.Envs.JWTSecret)
-	token, err := auth.CreateJWT(secret, u.ID.String())
+	token, err := auth.CreateJWT(secret, u.ID.String(), u.Role, sessionID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.AuthTokensResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    configs.Envs.JWTExpirationInSeconds,
+	}, nil
+}
+
+// @Summary Refresh an access token
+// @Description Exchange a refresh token for a new access token and a new refresh token. Each refresh token can only be used once.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param payload body types.RefreshTokenPayload true "Refresh token"
+// @Success 200 {object} types.AuthTokensResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /token/refresh [post]
+
+func (h *Handler) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var input types.RefreshTokenPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	refreshToken, err := auth.NewOpaqueToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	session, err := h.store.RotateRefreshToken(auth.HashToken(input.RefreshToken), &types.RefreshToken{
+		ID:        uuid.New(),
+		TokenHash: auth.HashToken(refreshToken),
+		ExpiresAt: now.Add(time.Second * time.Duration(configs.Envs.RefreshTokenExpirationInSeconds)),
+		CreatedAt: now,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	u, err := h.store.GetUserByID(session.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tokens, err := issueTokens(u, session.ID, refreshToken)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// @Summary Log out
+// @Description Revoke the session behind the current access token
+// @Tags Users
+// @Success 204 {object} nil
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /logout [post]
+
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	sessionID := types.SessionIDFromContext(r.Context())
+
+	if err := h.store.RevokeSession(sessionID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteNoContent(w)
+}
+
+// @Summary Log out of all devices
+// @Description Revoke every session of the authenticated user
+// @Tags Users
+// @Success 204 {object} nil
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /logout/all [post]
+
+func (h *Handler) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	if err := h.store.RevokeUserSessions(userID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteNoContent(w)
 }
 
 // @Summary Register a new user
@@ -111,19 +275,25 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.store.CreateUser(&types.User{
+	newUser := &types.User{
 		ID:        uuid.New(),
 		Name:      user.Name,
 		Email:     user.Email,
 		Password:  hashedPassword,
+		Role:      types.RoleCustomer,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
-	})
-	if err != nil {
+	}
+	if err := h.store.CreateUser(newUser); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	// a failed email must not fail the signup, the user can ask for a resend
+	if err := h.sendVerificationEmail(newUser); err != nil {
+		log.Printf("verification email for %s failed: %v", newUser.Email, err)
+	}
+
 	utils.WriteJSON(w, http.StatusCreated, nil)
 }
 
@@ -154,3 +324,268 @@ func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
 
 	utils.WriteJSON(w, http.StatusOK, user)
 }
+
+// @Summary Change a user's role
+// @Description Promote or demote a user (admin only)
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param userID path string true "User UUID"
+// @Param role body types.UpdateUserRolePayload true "New role"
+// @Success 200 {object} types.User
+// @Failure 400 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Security BearerAuth
+// @Router /users/{userID}/role [patch]
+
+func (h *Handler) handleUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	var input types.UpdateUserRolePayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.store.UpdateUserRole(userID, input.Role); errors.Is(err, sql.ErrNoRows) {
+		utils.WriteError(w, http.StatusNotFound, ErrUserNotFound)
+		return
+	} else if errors.Is(err, ErrLastAdmin) {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, user)
+}
+
+// issueUserToken stores a new single-use token for u and returns the plain
+// value to put in the emailed link.
+func (h *Handler) issueUserToken(u *types.User, purpose string, ttl time.Duration) (string, error) {
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = h.store.CreateUserToken(&types.UserToken{
+		ID:        uuid.New(),
+		UserID:    u.ID,
+		Purpose:   purpose,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (h *Handler) sendVerificationEmail(u *types.User) error {
+	token, err := h.issueUserToken(u, types.TokenPurposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", configs.Envs.FrontendURL, token)
+	return h.send(mail.Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %d hours.", u.Name, link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+func (h *Handler) send(msg mail.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	return h.mailer.Send(ctx, msg)
+}
+
+// @Summary Request a password reset
+// @Description Email a single-use password reset link. Always answers 202 so the endpoint cannot be used to probe for accounts.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param payload body types.ForgotPasswordPayload true "Account email"
+// @Success 202 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Router /password/forgot [post]
+
+func (h *Handler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var input types.ForgotPasswordPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if u, err := h.store.GetUserByEmail(input.Email); err == nil {
+		// send in the background so response time does not reveal the account
+		go func() {
+			token, err := h.issueUserToken(u, types.TokenPurposePasswordReset, passwordResetTTL)
+			if err != nil {
+				log.Printf("password reset token for %s failed: %v", u.Email, err)
+				return
+			}
+
+			link := fmt.Sprintf("%s/reset-password?token=%s", configs.Envs.FrontendURL, token)
+			err = h.send(mail.Message{
+				To:      u.Email,
+				Subject: "Reset your password",
+				Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. "+
+					"If it was you, open the link below:\n\n%s\n\nThe link expires in %d minutes. "+
+					"If it wasn't you, you can ignore this email.", u.Name, link, int(passwordResetTTL.Minutes())),
+			})
+			if err != nil {
+				log.Printf("password reset email for %s failed: %v", u.Email, err)
+			}
+		}()
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, map[string]string{
+		"status": "if the account exists, a reset link has been sent",
+	})
+}
+
+// @Summary Reset a password
+// @Description Set a new password with a token from a reset email. Every session of the user is revoked.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param payload body types.ResetPasswordPayload true "Reset token and new password"
+// @Success 204 {object} nil
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /password/reset [post]
+
+func (h *Handler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var input types.ResetPasswordPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(input.Password)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the token is only spent if the new password is stored
+	userID, err := h.store.ResetUserPassword(auth.HashToken(input.Token), hashedPassword)
+	if errors.Is(err, ErrInvalidToken) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the reset link was delivered to the inbox, so it proves ownership too
+	if err := h.store.MarkEmailVerified(userID); err != nil {
+		log.Printf("marking email verified for %s failed: %v", userID, err)
+	}
+
+	utils.WriteNoContent(w)
+}
+
+// @Summary Verify an email address
+// @Description Confirm the account email with a token from a verification email
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param payload body types.VerifyEmailPayload true "Verification token"
+// @Success 204 {object} nil
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /email/verify [post]
+
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var input types.VerifyEmailPayload
+	if err := utils.ParseJSON(r, &input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.store.ConsumeUserToken(types.TokenPurposeEmailVerification, auth.HashToken(input.Token))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.store.MarkEmailVerified(token.UserID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteNoContent(w)
+}
+
+// @Summary Resend the verification email
+// @Description Send a fresh verification link to the authenticated user. Earlier links stop working.
+// @Tags Users
+// @Produce json
+// @Success 202 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security BearerAuth
+// @Router /email/verify/resend [post]
+
+func (h *Handler) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(types.UserKey).(uuid.UUID)
+
+	u, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if u.EmailVerifiedAt != nil {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("email already verified"))
+		return
+	}
+
+	if err := h.sendVerificationEmail(u); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, map[string]string{"status": "verification email sent"})
+}
@@ -2,12 +2,25 @@ package user
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/kimenyu/executive/types"
 )
 
+// ErrUserNotFound is returned for unknown user IDs and emails. It wraps
+// sql.ErrNoRows, so callers can tell a missing user from a failed query.
+var ErrUserNotFound = fmt.Errorf("user not found: %w", sql.ErrNoRows)
+
+// ErrInvalidToken is returned for tokens that are unknown, expired, already
+// used or were issued for another purpose.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ErrLastAdmin is returned when a role change would leave no admin.
+var ErrLastAdmin = errors.New("cannot demote the last admin")
+
 type Store struct {
 	db *sql.DB
 }
@@ -16,11 +29,17 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
+const userColumns = "id, name, email, password, role, created_at, updated_at, email_verified_at"
+
 func (s *Store) CreateUser(user *types.User) error {
+	if user.Role == "" {
+		user.Role = types.RoleCustomer
+	}
+
 	_, err := s.db.Exec(`
-		INSERT INTO users (id, name, email, password, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, user.ID, user.Name, user.Email, user.Password, user.CreatedAt, user.UpdatedAt)
+		INSERT INTO users (id, name, email, password, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, user.ID, user.Name, user.Email, user.Password, user.Role, user.CreatedAt, user.UpdatedAt)
 
 	if err != nil {
 		return err
@@ -29,10 +48,11 @@ func (s *Store) CreateUser(user *types.User) error {
 }
 
 func (s *Store) GetUserByEmail(email string) (*types.User, error) {
-	rows, err := s.db.Query("SELECT * FROM users WHERE email = $1", email)
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE email = $1", email)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	u := new(types.User)
 	for rows.Next() {
@@ -42,18 +62,23 @@ func (s *Store) GetUserByEmail(email string) (*types.User, error) {
 		}
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
 	if u.ID == uuid.Nil {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	return u, nil
 }
 
 func (s *Store) GetUserByID(id uuid.UUID) (*types.User, error) {
-	rows, err := s.db.Query("SELECT * FROM users WHERE id = $1", id)
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE id = $1", id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	u := new(types.User)
 	for rows.Next() {
@@ -61,31 +86,324 @@ func (s *Store) GetUserByID(id uuid.UUID) (*types.User, error) {
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		if u.ID == uuid.Nil {
-			return nil, fmt.Errorf("user not found")
-		}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
+	if u.ID == uuid.Nil {
+		return nil, ErrUserNotFound
 	}
 
 	return u, nil
 }
 
+// UpdateUserRole changes a user's role. Admin rows are locked while the
+// change is made, so two concurrent demotions cannot both pass the last
+// admin check.
+func (s *Store) UpdateUserRole(id uuid.UUID, role string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM users WHERE role = $1 ORDER BY id FOR UPDATE`, types.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	admins, isAdmin := 0, false
+	for rows.Next() {
+		var adminID uuid.UUID
+		if err := rows.Scan(&adminID); err != nil {
+			rows.Close()
+			return err
+		}
+		admins++
+		isAdmin = isAdmin || adminID == id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if isAdmin && role != types.RoleAdmin && admins == 1 {
+		return ErrLastAdmin
+	}
+
+	res, err := tx.Exec(`UPDATE users SET role = $1, updated_at = $2 WHERE id = $3`, role, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *Store) CreateSession(session *types.Session, token *types.RefreshToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO sessions (id, user_id, user_agent, ip, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, session.ID, session.UserID, session.UserAgent, session.IP, session.ExpiresAt, session.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := insertRefreshToken(tx, token); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) GetSessionByID(id uuid.UUID) (*types.Session, error) {
+	row := s.db.QueryRow(`
+		SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip, ''), expires_at, revoked_at, created_at
+		FROM sessions WHERE id = $1
+	`, id)
+
+	var session types.Session
+	var revokedAt sql.NullTime
+	err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+		&session.ExpiresAt, &revokedAt, &session.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	return &session, nil
+}
+
+// RotateRefreshToken spends the refresh token with the given hash and stores
+// next in its place. Presenting an already spent token is treated as theft:
+// the whole session is revoked.
+func (s *Store) RotateRefreshToken(tokenHash string, next *types.RefreshToken) (*types.Session, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID   uuid.UUID
+		sessionID uuid.UUID
+		expiresAt time.Time
+		usedAt    sql.NullTime
+	)
+	err = tx.QueryRow(`
+		SELECT id, session_id, expires_at, used_at
+		FROM refresh_tokens WHERE token_hash = $1
+		FOR UPDATE
+	`, tokenHash).Scan(&tokenID, &sessionID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, time.Now(), sessionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("refresh token reused, session revoked")
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("refresh token expired")
+	}
+
+	var session types.Session
+	var revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip, ''), expires_at, revoked_at, created_at
+		FROM sessions WHERE id = $1
+	`, sessionID).Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+		&session.ExpiresAt, &revokedAt, &session.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	if !session.Active() {
+		return nil, fmt.Errorf("session expired or revoked")
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = $1 WHERE id = $2`, time.Now(), tokenID); err != nil {
+		return nil, err
+	}
+
+	next.SessionID = session.ID
+	if next.ExpiresAt.After(session.ExpiresAt) {
+		next.ExpiresAt = session.ExpiresAt
+	}
+	if err := insertRefreshToken(tx, next); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *Store) RevokeSession(id uuid.UUID) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, time.Now(), id)
+	return err
+}
+
+func (s *Store) RevokeUserSessions(userID uuid.UUID) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, time.Now(), userID)
+	return err
+}
+
+// ResetUserPassword spends the password reset token with the given hash,
+// sets a new password for its user and revokes their sessions, and returns
+// the user's ID. Doing it all at once means a failed reset leaves the link
+// usable, and a successful one never leaves an attacker's session alive.
+func (s *Store) ResetUserPassword(tokenHash string, hashedPassword string) (uuid.UUID, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE user_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id
+	`, now, tokenHash, types.TokenPurposePasswordReset).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrInvalidToken
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	res, err := tx.Exec(`UPDATE users SET password = $1, updated_at = $2 WHERE id = $3`, hashedPassword, now, userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if rowsAffected == 0 {
+		return uuid.Nil, ErrUserNotFound
+	}
+
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, now, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	return userID, tx.Commit()
+}
+
+func (s *Store) MarkEmailVerified(id uuid.UUID) error {
+	_, err := s.db.Exec(`UPDATE users SET email_verified_at = $1 WHERE id = $2 AND email_verified_at IS NULL`, time.Now(), id)
+	return err
+}
+
+// CreateUserToken stores token and invalidates any earlier unused token the
+// user holds for the same purpose, so only the latest emailed link works.
+func (s *Store) CreateUserToken(token *types.UserToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE user_tokens SET used_at = $1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL`,
+		token.CreatedAt, token.UserID, token.Purpose)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_tokens (id, user_id, purpose, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, token.ID, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConsumeUserToken marks the token as used and returns it. It fails if the
+// token is unknown, expired, already used or was issued for another purpose.
+func (s *Store) ConsumeUserToken(purpose string, tokenHash string) (*types.UserToken, error) {
+	now := time.Now()
+	row := s.db.QueryRow(`
+		UPDATE user_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING id, user_id, purpose, token_hash, expires_at, created_at
+	`, now, tokenHash, purpose)
+
+	var token types.UserToken
+	err := row.Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.ExpiresAt, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token.UsedAt = &now
+	return &token, nil
+}
+
+func insertRefreshToken(tx *sql.Tx, token *types.RefreshToken) error {
+	_, err := tx.Exec(`
+		INSERT INTO refresh_tokens (id, session_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, token.ID, token.SessionID, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
 func scanRowsIntoUser(rows *sql.Rows) (*types.User, error) {
 	user := new(types.User)
+	var emailVerifiedAt sql.NullTime
 
 	err := rows.Scan(
 		&user.ID,
 		&user.Name,
 		&user.Email,
 		&user.Password,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&emailVerifiedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+
 	return user, nil
 }
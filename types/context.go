@@ -8,7 +8,11 @@ import (
 
 type contextKey string
 
-const UserKey contextKey = "userID"
+const (
+	UserKey    contextKey = "userID"
+	RoleKey    contextKey = "role"
+	SessionKey contextKey = "sessionID"
+)
 
 func UserIDFromContext(ctx context.Context) uuid.UUID {
 	userID, ok := ctx.Value(UserKey).(uuid.UUID)
@@ -17,3 +21,19 @@ func UserIDFromContext(ctx context.Context) uuid.UUID {
 	}
 	return userID
 }
+
+func RoleFromContext(ctx context.Context) string {
+	role, ok := ctx.Value(RoleKey).(string)
+	if !ok {
+		return ""
+	}
+	return role
+}
+
+func SessionIDFromContext(ctx context.Context) uuid.UUID {
+	sessionID, ok := ctx.Value(SessionKey).(uuid.UUID)
+	if !ok {
+		return uuid.Nil
+	}
+	return sessionID
+}
@@ -0,0 +1,176 @@
+package types
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used for amounts read from columns without a
+// currency of their own.
+const DefaultCurrency = "KES"
+
+// Money is an exact amount in minor units (cents) of a currency. It is
+// stored in NUMERIC(12,2) columns and encoded in JSON as a decimal string
+// such as "1500.00", so no float ever touches a price.
+type Money struct {
+	Amount   int64  // minor units
+	Currency string // ISO 4217 code
+}
+
+// NewMoney returns minor units of the default currency.
+func NewMoney(minor int64) Money {
+	return Money{Amount: minor, Currency: DefaultCurrency}
+}
+
+// ParseMoney reads a decimal amount such as "1500", "1500.5" or "-3.25".
+// More than two decimal places is an error rather than a silent rounding.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, _ := strings.Cut(s, ".")
+
+	neg := strings.HasPrefix(whole, "-")
+	whole = strings.TrimPrefix(strings.TrimPrefix(whole, "-"), "+")
+	if whole == "" && frac == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	// NUMERIC may render trailing zeros beyond the column's scale
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > 2 {
+		return Money{}, fmt.Errorf("invalid amount %q: more than two decimal places", s)
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+
+	if whole == "" {
+		whole = "0"
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return Money{}, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q: %w", s, err)
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+
+	minor := units*100 + cents
+	if neg {
+		minor = -minor
+	}
+	return NewMoney(minor), nil
+}
+
+// String renders the amount with two decimal places, without currency.
+func (m Money) String() string {
+	sign, minor := "", m.Amount
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/100, minor%100)
+}
+
+func (m Money) IsZero() bool { return m.Amount == 0 }
+
+// Equal compares amounts. An empty currency matches any currency.
+func (m Money) Equal(o Money) bool {
+	return m.Amount == o.Amount && (m.Currency == o.Currency || m.Currency == "" || o.Currency == "")
+}
+
+func (m Money) Add(o Money) Money {
+	return Money{Amount: m.Amount + o.Amount, Currency: m.currencyWith(o)}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{Amount: m.Amount - o.Amount, Currency: m.currencyWith(o)}
+}
+
+// Mul returns the amount times n, e.g. a line total.
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Units returns the whole currency units, rounding any cents up. It is
+// what providers that only take whole amounts, like M-Pesa, are charged.
+func (m Money) Units() int64 {
+	if m.Amount <= 0 {
+		return m.Amount / 100
+	}
+	return (m.Amount + 99) / 100
+}
+
+func (m Money) currencyWith(o Money) string {
+	if m.Currency != "" {
+		return m.Currency
+	}
+	return o.Currency
+}
+
+// Scan reads NUMERIC columns, which lib/pq returns as text. NULL scans as
+// zero.
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = NewMoney(0)
+		return nil
+	case []byte:
+		parsed, err := ParseMoney(string(v))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	case string:
+		parsed, err := ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	case int64:
+		*m = NewMoney(v * 100)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+}
+
+// Value writes the decimal string, which NUMERIC stores exactly.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts "1500.00" as well as plain numbers such as 1500.5;
+// numbers are parsed from their literal text, not through a float.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*m = Money{}
+		return nil
+	}
+
+	s := string(b)
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else if strings.ContainsAny(s, "eE") {
+		return fmt.Errorf("invalid amount %s: use a plain decimal", s)
+	}
+
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -12,14 +12,104 @@ type User struct {
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
 	Password  string    `json:"-"`
+	Role      string    `json:"role"` // customer, staff, admin
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 }
 
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
 type UserStore interface {
 	GetUserByEmail(email string) (*User, error)
 	GetUserByID(id uuid.UUID) (*User, error)
 	CreateUser(user *User) error
+	UpdateUserRole(id uuid.UUID, role string) error
+
+	CreateSession(session *Session, token *RefreshToken) error
+	GetSessionByID(id uuid.UUID) (*Session, error)
+	RotateRefreshToken(tokenHash string, next *RefreshToken) (*Session, error)
+	RevokeSession(id uuid.UUID) error
+	RevokeUserSessions(userID uuid.UUID) error
+
+	// ResetUserPassword spends a password reset token, sets the password
+	// of its user and revokes their sessions in one transaction
+	ResetUserPassword(tokenHash string, hashedPassword string) (uuid.UUID, error)
+	MarkEmailVerified(id uuid.UUID) error
+	CreateUserToken(token *UserToken) error
+	ConsumeUserToken(purpose string, tokenHash string) (*UserToken, error)
+}
+
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+)
+
+// UserToken is a single-use token sent by email. Only the hash is stored.
+type UserToken struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type ForgotPasswordPayload struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=3,max=130"`
+}
+
+type VerifyEmailPayload struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type Session struct {
+	ID        uuid.UUID  `json:"id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	UserAgent string     `json:"user_agent"`
+	IP        string     `json:"ip"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Active reports whether the session can still be used to authenticate.
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+type RefreshToken struct {
+	ID        uuid.UUID
+	SessionID uuid.UUID
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type RefreshTokenPayload struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type AuthTokensResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // access token lifetime in seconds
+}
+
+type UpdateUserRolePayload struct {
+	Role string `json:"role" validate:"required,oneof=customer staff admin"`
 }
 
 type RegisterUserPayload struct {
@@ -34,48 +124,263 @@ type LoginUserPayload struct {
 }
 
 type Category struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID     `json:"id"`
+	ParentID  uuid.NullUUID `json:"parent_id"`
+	Name      string        `json:"name"`
+	Slug      string        `json:"slug"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
 }
 
+// CategoryNode is a category with its subcategories, as returned by the
+// tree endpoint.
+type CategoryNode struct {
+	Category
+	Children []*CategoryNode `json:"children"`
+}
+
+// What happens to the products and subcategories of a deleted category.
+const (
+	// refuse to delete a category that still has either
+	CategoryDeleteRestrict = "restrict"
+	// move both up to the deleted category's parent; products of a top
+	// level category end up uncategorised
+	CategoryDeleteReparent = "reparent"
+	// move subcategories up and leave the products uncategorised
+	CategoryDeleteDetach = "detach"
+)
+
+// CreateCategoryPayload creates or replaces a category. An empty slug is derived
+// from the name on create and left unchanged on update.
 type CreateCategoryPayload struct {
-	Name string `json:"name" validate:"required"`
+	Name     string        `json:"name" validate:"required,max=100"`
+	Slug     string        `json:"slug" validate:"omitempty,max=100,slug"`
+	ParentID uuid.NullUUID `json:"parent_id"`
 }
+
 type CategoryStore interface {
 	CreateCategory(category *Category) error
 	GetCategories() ([]*Category, error)
 	GetCategoryById(id uuid.UUID) (*Category, error)
+	GetCategoryBySlug(slug string) (*Category, error)
+	// UpdateCategory renames and moves a category, refusing cycles
+	UpdateCategory(category *Category) error
+	DeleteCategory(id uuid.UUID, policy string) error
 }
 
 type Product struct {
 	ID          uuid.UUID `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
-	Price       float64   `json:"price"`
+	Price       Money     `json:"price"`
 	Image       string    `json:"image"`
 	CategoryID  uuid.UUID `json:"category_id"`
 	Quantity    int       `json:"quantity"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	// set while the product is archived: hidden from the catalog but still
+	// referenced by orders
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+
+	// aggregated from reviews, read-only
+	Rating      float64 `json:"rating"`
+	ReviewCount int     `json:"review_count"`
+
+	// loaded for single product responses
+	Variants []ProductVariant `json:"variants,omitempty"`
+	Images   []ProductImage   `json:"images,omitempty"`
+}
+
+// ProductImage is an uploaded image of a product. Image holds the URL of
+// the primary one for older clients.
+type ProductImage struct {
+	ID           uuid.UUID `json:"id"`
+	ProductID    uuid.UUID `json:"product_id"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	ContentType  string    `json:"content_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Position     int       `json:"position"`
+	IsPrimary    bool      `json:"is_primary"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// blob store keys
+	Key          string `json:"-"`
+	ThumbnailKey string `json:"-"`
+}
+
+type ReorderImagesPayload struct {
+	ImageIDs []uuid.UUID `json:"image_ids" validate:"required,min=1"`
+}
+
+// ProductVariant is a sellable version of a product, e.g. a size and
+// color. Stock lives on variants; Product.Quantity is their total.
+type ProductVariant struct {
+	ID        uuid.UUID         `json:"id"`
+	ProductID uuid.UUID         `json:"product_id"`
+	SKU       string            `json:"sku"`
+	Options   map[string]string `json:"options"`
+	// PriceOverride replaces the product price when set
+	PriceOverride *Money    `json:"price_override,omitempty"`
+	Price         Money     `json:"price"` // effective price
+	Quantity      int       `json:"quantity"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type VariantPayload struct {
+	SKU           string            `json:"sku" validate:"required,max=64"`
+	Options       map[string]string `json:"options" validate:"dive,keys,required,max=32,endkeys,required,max=64"`
+	PriceOverride *Money            `json:"price_override" validate:"omitempty,gt=0"`
+	Quantity      int               `json:"quantity" validate:"min=0"`
 }
 
 // used in the http layer only(to handler user input)
 type CreateProductPayload struct {
-	Name        string  `json:"name" validate:"required"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price" validate:"required"`
-	Image       string  `json:"image"`
-	CategoryID  string  `json:"category_id"`
-	Quantity    int     `json:"quantity" validate:"required"`
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description"`
+	Price       Money  `json:"price" validate:"gt=0"`
+	Image       string `json:"image"`
+	CategoryID  string `json:"category_id"`
+	Quantity    int    `json:"quantity" validate:"required"`
+	// SKU of the default variant created with the product, generated when empty
+	SKU string `json:"sku" validate:"omitempty,max=64"`
+}
+
+// CatalogRow is one variant of a product in a catalog import or export.
+// Rows are matched to existing variants by SKU; product fields are shared
+// by all rows of a product.
+type CatalogRow struct {
+	// Line is where the row starts in the import file, for error reports
+	Line int `json:"-"`
+
+	// ProductID groups variants of one product. Rows with an unknown SKU
+	// become a new variant of this product, which is created with this id
+	// if needed; without it they join the product of an earlier row with
+	// the same name, or become a new product.
+	ProductID uuid.NullUUID `json:"product_id"`
+	SKU       string        `json:"sku" validate:"required,max=64"`
+	Name      string        `json:"name" validate:"required"`
+	// Description is the product's description; empty keeps the current one
+	Description string `json:"description"`
+	Price       Money  `json:"price" validate:"gt=0"`
+	// PriceOverride replaces the product price for this variant; nil keeps
+	// the current override
+	PriceOverride *Money `json:"price_override,omitempty" validate:"omitempty,gt=0"`
+	// Category is a category slug or name; empty keeps the current one
+	Category string            `json:"category"`
+	Options  map[string]string `json:"options" validate:"dive,keys,required,max=32,endkeys,required,max=64"`
+	// Quantity is the variant's stock; nil keeps the current stock
+	Quantity *int `json:"quantity" validate:"omitempty,min=0"`
+	// Image is a URL; empty keeps the current one
+	Image string `json:"image"`
+}
+
+// ImportReport summarises a catalog import. Created and Updated count
+// variants; in a dry run they are what the import would have done.
+type ImportReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Rows    int              `json:"rows"`
+	Created int              `json:"created"`
+	Updated int              `json:"updated"`
+	Failed  int              `json:"failed"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	SKU   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+// Sort orders for product listings.
+const (
+	ProductSortNewest    = "newest"
+	ProductSortPriceAsc  = "price_asc"
+	ProductSortPriceDesc = "price_desc"
+	ProductSortName      = "name"
+	ProductSortRating    = "rating"
+)
+
+// ProductFilter narrows and orders a product listing. Nil and zero fields
+// don't filter.
+type ProductFilter struct {
+	// CategoryID and CategorySlug match the category and all of its
+	// descendants
+	CategoryID   *uuid.UUID
+	CategorySlug string
+	MinPrice     *Money
+	MaxPrice     *Money
+	InStock      bool
+	// Archived lists archived products instead of the live catalog
+	Archived bool
+	Sort     string
+	Page     int // 1-based
+	PerPage  int
+}
+
+// Pagination describes the page a listing returned.
+type Pagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+type ProductList struct {
+	Products   []*Product `json:"products"`
+	Pagination Pagination `json:"pagination"`
+}
+
+// ProductSearchResult is a product matched by a search, with its relevance
+// and the matching text highlighted in <mark> tags. The highlights contain
+// stored text as is, so clients must escape it before rendering as HTML.
+type ProductSearchResult struct {
+	*Product
+	Rank          float64 `json:"rank"`
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
+}
+
+type ProductSearchList struct {
+	Results    []*ProductSearchResult `json:"results"`
+	Pagination Pagination             `json:"pagination"`
 }
 
 type ProductStore interface {
 	CreateProduct(product *Product) error
 	GetProductByID(id uuid.UUID) (*Product, error)
-	GetAllProducts() ([]*Product, error)
-	DeleteProduct(id uuid.UUID) error
+	ListProducts(filter ProductFilter) (*ProductList, error)
+	SearchProducts(query string, filter ProductFilter) (*ProductSearchList, error)
+	// ArchiveProduct hides a product from the catalog; RestoreProduct
+	// brings it back
+	ArchiveProduct(id uuid.UUID) error
+	RestoreProduct(id uuid.UUID) error
 	UpdateProduct(product *Product) error
+
+	// CreateProduct adds a default variant with the product's quantity
+	CreateVariant(variant *ProductVariant) error
+	GetVariant(id uuid.UUID) (*ProductVariant, error)
+	ListVariants(productID uuid.UUID) ([]ProductVariant, error)
+	UpdateVariant(variant *ProductVariant) error
+	DeleteVariant(productID, variantID uuid.UUID) error
+
+	// AddImages appends images after the existing ones; the first image of
+	// a product becomes its primary one
+	AddImages(productID uuid.UUID, images []ProductImage) error
+	ListImages(productID uuid.UUID) ([]ProductImage, error)
+	SetPrimaryImage(productID, imageID uuid.UUID) error
+	ReorderImages(productID uuid.UUID, imageIDs []uuid.UUID) error
+	// DeleteImage returns the removed image so its blobs can be cleaned up
+	DeleteImage(productID, imageID uuid.UUID) (*ProductImage, error)
+	SetProductImage(productID uuid.UUID, url string) error
+
+	// ImportProducts upserts rows by SKU in one transaction, skipping rows
+	// that fail and rolling everything back on a dry run
+	ImportProducts(rows []CatalogRow, dryRun bool) (*ImportReport, error)
+	// ExportProducts calls fn for every variant, stopping at its first error
+	ExportProducts(fn func(CatalogRow) error) error
 }
 type Cart struct {
 	ID        uuid.UUID `json:"id"`
@@ -87,86 +392,262 @@ type CartItem struct {
 	ID        uuid.UUID `json:"id"`
 	CartID    uuid.UUID `json:"cart_id"`
 	ProductID uuid.UUID `json:"product_id"`
+	VariantID uuid.UUID `json:"variant_id"`
 	Quantity  int       `json:"quantity"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// CartItemDetailed is a cart line priced from the current catalog
+type CartItemDetailed struct {
+	ID          uuid.UUID         `json:"id"`
+	ProductID   uuid.UUID         `json:"product_id"`
+	VariantID   uuid.UUID         `json:"variant_id"`
+	SKU         string            `json:"sku"`
+	Options     map[string]string `json:"options"`
+	ProductName string            `json:"product_name"`
+	Image       string            `json:"image"`
+	UnitPrice   Money             `json:"unit_price"`
+	Quantity    int               `json:"quantity"`
+	LineTotal   Money             `json:"line_total"`
+	InStock     bool              `json:"in_stock"`
+}
+
+type CartView struct {
+	CartID   uuid.UUID          `json:"cart_id"`
+	Items    []CartItemDetailed `json:"items"`
+	Subtotal Money              `json:"subtotal"`
+}
+
 type CartStore interface {
 	GetCartByUserID(userID uuid.UUID) (*Cart, error)
 	CreateCart(cart *Cart) error
+	// AddCartItem adds to the quantity when the variant is already in the cart
 	AddCartItem(item *CartItem) error
 	GetCartItems(cartID uuid.UUID) ([]CartItem, error)
+	GetCartView(cartID uuid.UUID) (*CartView, error)
+	UpdateCartItemQuantity(cartID, itemID uuid.UUID, quantity int) error
+	RemoveCartItem(cartID, itemID uuid.UUID) error
+	ClearCart(cartID uuid.UUID) error
 }
 
 type AddToCartPayload struct {
 	Quantity int `json:"quantity" validate:"required,min=1"`
+	// VariantID may be left out for products with a single variant
+	VariantID uuid.NullUUID `json:"variant_id"`
+}
+
+type UpdateCartItemPayload struct {
+	Quantity int `json:"quantity" validate:"required,min=1"`
 }
 
 type Order struct {
 	ID        uuid.UUID `json:"id"`
 	UserID    uuid.UUID `json:"user_id"`
-	Total     float64   `json:"total"`
-	Status    string    `json:"status"` // pending, paid, shipped, cancelled
+	Total     Money     `json:"total"`
+	Status    string    `json:"status"` // see OrderStatus* constants
 	AddressID uuid.UUID `json:"address_id"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// NeedsRefund flags paid orders that were cancelled
+	NeedsRefund bool `json:"needs_refund"`
+	// PaymentProvider is the payment method picked at checkout
+	PaymentProvider string `json:"payment_provider"`
+}
+
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusPaid      = "paid"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCompleted = "completed"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+
+	OrderStatusPartiallyRefunded = "partially_refunded"
+)
+
+// OrderStatusChange is one entry of an order's timeline. ActorID is null
+// for changes made by the system, e.g. a payment callback.
+type OrderStatusChange struct {
+	ID         uuid.UUID     `json:"id"`
+	FromStatus string        `json:"from_status,omitempty"`
+	ToStatus   string        `json:"to_status"`
+	ActorID    uuid.NullUUID `json:"actor_id"`
+	Note       string        `json:"note,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
 }
 
 type OrderItem struct {
 	ID        uuid.UUID `json:"id"`
 	OrderID   uuid.UUID `json:"order_id"`
 	ProductID uuid.UUID `json:"product_id"`
+	VariantID uuid.UUID `json:"variant_id"`
+	SKU       string    `json:"sku"`
 	Quantity  int       `json:"quantity"`
-	Price     float64   `json:"price"`
+	Price     Money     `json:"price"`
 }
 
 type CreateOrderPayload struct {
-	Items []CreateOrderItemDTO `json:"items" validate:"required,dive"`
-	Total float64              `json:"total" validate:"required,gt=0"`
+	Items []CreateOrderItemDTO `json:"items" validate:"required,min=1,dive"`
+	// Total is optional. Prices always come from the catalog; when a total is
+	// sent it is only compared against the computed one.
+	Total Money `json:"total" validate:"omitempty,gt=0"`
+	// PaymentProvider defaults to M-Pesa
+	PaymentProvider string `json:"payment_provider" validate:"omitempty,oneof=mpesa card cod"`
+}
+
+type CheckoutPayload struct {
+	AddressID uuid.UUID `json:"address_id" validate:"required"`
+	// Total is optional and only compared against the computed total
+	Total Money `json:"total" validate:"omitempty,gt=0"`
+	// PaymentProvider defaults to M-Pesa
+	PaymentProvider string `json:"payment_provider" validate:"omitempty,oneof=mpesa card cod"`
 }
 
 type CreateOrderItemDTO struct {
 	ProductID uuid.UUID `json:"product_id" validate:"required"`
-	Quantity  int       `json:"quantity" validate:"required,min=1"`
-	Price     float64   `json:"price" validate:"required,gt=0"`
+	// VariantID may be left out for products with a single variant
+	VariantID uuid.NullUUID `json:"variant_id"`
+	Quantity  int           `json:"quantity" validate:"required,min=1"`
 }
 
 type OrderItemDetailed struct {
-	ID          uuid.UUID `json:"id"`
-	ProductID   uuid.UUID `json:"product_id"`
-	ProductName string    `json:"product_name"`
-	Quantity    int       `json:"quantity"`
-	Price       float64   `json:"price"`
+	ID          uuid.UUID     `json:"id"`
+	ProductID   uuid.UUID     `json:"product_id"`
+	VariantID   uuid.NullUUID `json:"variant_id"`
+	SKU         string        `json:"sku"`
+	ProductName string        `json:"product_name"`
+	Quantity    int           `json:"quantity"`
+	Price       Money         `json:"price"`
 }
 
 type OrderWithItems struct {
-	Order Order               `json:"order"`
-	Items []OrderItemDetailed `json:"items"`
+	Order   Order               `json:"order"`
+	Items   []OrderItemDetailed `json:"items"`
+	History []OrderStatusChange `json:"history"`
 }
 
 type UpdateOrderPayload struct {
-	Status string `json:"status" validate:"required,oneof=pending paid shipped completed cancelled"`
+	Status string `json:"status" validate:"required,oneof=paid shipped delivered completed cancelled refunded"`
+	Note   string `json:"note"`
+}
+
+type CancelOrderPayload struct {
+	Reason string `json:"reason"`
 }
 
 type OrderStore interface {
-	CreateOrder(order *Order) error
-	AddOrderItem(item *OrderItem) error
+	// PlaceOrder inserts the order and its items and takes the items out of
+	// stock, all or nothing.
+	PlaceOrder(order *Order, items []OrderItem) error
 	GetOrdersByUser(userID uuid.UUID) ([]Order, error)
 	GetOrderWithItemsByID(orderID uuid.UUID) (*OrderWithItems, error)
-	UpdateOrder(order *Order) error
-	UpdateOrderStatus(orderID uuid.UUID, status string) error
+	// TransitionOrderStatus moves the order to status if the state machine
+	// allows it and records the change in the order's history. Cancelling
+	// returns the items to stock and flags paid orders for refund.
+	TransitionOrderStatus(orderID uuid.UUID, status string, actorID uuid.NullUUID, note string) (*Order, error)
+	SetPaymentProvider(orderID uuid.UUID, provider string) error
 }
 type Payment struct {
 	ID                uuid.UUID       `json:"id"`
 	OrderID           uuid.UUID       `json:"order_id"`
-	Amount            float64         `json:"amount"`
-	Provider          string          `json:"provider"`
-	Status            string          `json:"status"`
-	CheckoutRequestID string          `json:"checkout_request_id"`
+	Amount            Money           `json:"amount"`
+	Provider          string          `json:"provider"`            // see PaymentProvider* constants
+	Status            string          `json:"status"`              // see PaymentStatus* constants
+	CheckoutRequestID string          `json:"checkout_request_id"` // the provider's reference, e.g. a card charge ID
 	MerchantRequestID string          `json:"merchant_request_id"`
-	MpesaReceipt      string          `json:"mpesa_receipt"`
+	MpesaReceipt      string          `json:"mpesa_receipt"` // the provider's receipt number
 	Phone             string          `json:"phone"`
 	Metadata          json.RawMessage `json:"metadata"`
+	NeedsReview       bool            `json:"needs_review"` // pending and left for someone to check with the provider
+	CreatedAt         time.Time       `json:"created_at"`
+}
+
+type MpesaPayPayload struct {
+	Phone string `json:"phone" validate:"required"`
+}
+
+// Refund is money returned against a successful payment. Refunds that
+// are pending or successful count towards the payment's captured amount.
+type Refund struct {
+	ID                uuid.UUID       `json:"id"`
+	PaymentID         uuid.UUID       `json:"payment_id"`
+	OrderID           uuid.UUID       `json:"order_id"`
+	Amount            Money           `json:"amount"`
+	Status            string          `json:"status"` // see PaymentStatus* constants
+	Reason            string          `json:"reason"`
+	ProviderReference string          `json:"provider_reference"`
+	ActorID           uuid.NullUUID   `json:"actor_id"`
+	Metadata          json.RawMessage `json:"metadata"`
 	CreatedAt         time.Time       `json:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at"`
+}
+
+// CreateRefundPayload refunds Amount, or everything not yet refunded when
+// it is omitted. PaymentID defaults to the order's latest successful
+// payment.
+type CreateRefundPayload struct {
+	PaymentID uuid.UUID `json:"payment_id"`
+	Amount    Money     `json:"amount" validate:"omitempty,gt=0"`
+	Reason    string    `json:"reason" validate:"required"`
+}
+
+// ResolveRefundPayload settles a refund left pending because the
+// provider's answer was lost, once an admin has checked with the provider.
+type ResolveRefundPayload struct {
+	Status string `json:"status" validate:"required,oneof=success failed"`
+	Note   string `json:"note" validate:"required"`
+}
+
+// PayOrderPayload starts a payment for an order. Provider defaults to the
+// one picked at checkout; Phone is required for M-Pesa.
+type PayOrderPayload struct {
+	Provider string `json:"provider" validate:"omitempty,oneof=mpesa card cod"`
+	Phone    string `json:"phone"`
+}
+
+const (
+	PaymentProviderMpesa = "mpesa"
+	PaymentProviderCard  = "card"
+	PaymentProviderCOD   = "cod" // cash on delivery
+)
+
+const (
+	PaymentStatusPending = "pending"
+	PaymentStatusSuccess = "success"
+	PaymentStatusFailed  = "failed"
+)
+
+type PaymentStore interface {
+	CreatePayment(p *Payment) error
+	GetPaymentByID(id uuid.UUID) (*Payment, error)
+	GetPaymentByCheckoutID(checkout string) (*Payment, error)
+	GetPaymentByReceipt(receipt string) (*Payment, error)
+	// UpsertPayment only moves a pending payment forward; changed is false
+	// when the stored payment was left as it was.
+	UpsertPayment(p *Payment) (stored *Payment, changed bool, err error)
+	// CompletePayment returns sql.ErrNoRows if the payment is no longer
+	// pending. Both it and UpsertPayment mark the order paid on success,
+	// or flag it for a refund when it is no longer pending.
+	CompletePayment(p *Payment) error
+	SetCheckoutRequest(id uuid.UUID, checkoutRequestID, merchantRequestID string) error
+	GetPendingPayment(orderID uuid.UUID, provider string) (*Payment, error)
+	ListStalePendingPayments(cutoff time.Time, providers []string, limit int) ([]Payment, error)
+	FlagPaymentForReview(id uuid.UUID) error
+	GetCapturedPayment(orderID uuid.UUID) (*Payment, error)
+
+	// CreateRefund reserves the refund's amount against its payment.
+	CreateRefund(r *Refund) error
+	// SetRefundReference links a refund to the provider's request and
+	// records the amount that was actually sent.
+	SetRefundReference(id uuid.UUID, reference string, amount Money) error
+	// CompleteRefund returns sql.ErrNoRows if the refund is no longer
+	// pending.
+	CompleteRefund(id uuid.UUID, status string, metadata json.RawMessage) (*Refund, error)
+	GetRefundByReference(reference string) (*Refund, error)
+	ListRefundsByOrder(orderID uuid.UUID) ([]Refund, error)
+	RefundTotals(orderID uuid.UUID) (captured, refunded Money, err error)
+	ClearNeedsRefund(orderID uuid.UUID) error
 }
 
 type Review struct {
@@ -205,6 +686,7 @@ type Address struct {
 type AddressStore interface {
 	CreateAddress(address *Address) error
 	GetAddress(userID uuid.UUID) (*Address, error)
+	GetAddressByID(id uuid.UUID) (*Address, error)
 	UpdateAddress(address *Address) error
 }
 